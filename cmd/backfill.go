@@ -0,0 +1,124 @@
+//  Copyright 2016 Red Hat, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fabric8io/gitcollector/pkg/client"
+	"github.com/fabric8io/gitcollector/pkg/config"
+	"github.com/fabric8io/gitcollector/pkg/util"
+	"github.com/fabric8io/gitcollector/pkg/watcher"
+	"github.com/spf13/cobra"
+
+	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+)
+
+func init() {
+	RootCmd.AddCommand(newBackfillCommand())
+}
+
+func newBackfillCommand() *cobra.Command {
+	p := &watcher.WatchFlags{}
+	o := &watcher.BackfillOptions{}
+	backfill := ""
+	configFile := ""
+	cmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Republishes the history of a BuildConfig",
+		Long:  `This command republishes a range of the git history of a BuildConfig such as after the history was lost by Elasticsearch or the Work Item Tracker`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var cfg *config.Config
+			var err error
+			if len(configFile) > 0 {
+				// the backfill of the file is how much history the operator first publishes
+				cfg, err = applyConfig(cmd.Flags(), configFile, "backfill")
+			}
+			if err == nil {
+				o.Backfill, err = watcher.ParseBackfill(backfill)
+			}
+			if err == nil {
+				err = backfillCommand(cmd, args, p, o, cfg)
+			}
+			handleError(err)
+		},
+	}
+	f := cmd.Flags()
+	f.StringVar(&configFile, "config", "", "the YAML or JSON configuration file of the operator to use the sinks, filters and limits of; flags override its values")
+	f.StringVarP(&o.Namespace, "namespace", "n", "", "the namespace of the BuildConfig. Defaults to the current namespace")
+	f.StringVarP(&o.BuildConfig, "buildconfig", "b", "", "the name of the BuildConfig to republish")
+	f.StringVar(&backfill, "backfill", "all", "how much history to republish: all, a number of commits or a date such as 2017-01-31")
+	f.StringVar(&o.From, "from", "", "only republish the history after this commit or ref")
+	f.StringVar(&o.To, "to", "", "only republish the history up to this commit or ref. Defaults to the ref of the BuildConfig")
+	f.StringVarP(&p.WorkDir, "workdir", "w", "./workdir", "the directory to store work files like git clones")
+	f.IntVar(&p.BatchSize, "batchSize", 10, "the number of commits published within each read timeout")
+	f.DurationVar(&p.GitTimeouts.Clone, "cloneTimeout", 0, "how long a git clone can take before it is killed")
+	f.DurationVar(&p.GitTimeouts.Fetch, "fetchTimeout", 0, "how long a git fetch can take before it is killed")
+	f.DurationVar(&p.GitTimeouts.Read, "readTimeout", 0, "how long reading the history of a git clone can take before it is killed")
+	f.StringVar(&p.GitBackend, "gitBackend", "auto", "how git repositories are cloned: exec to use the git binary, go-git to use the pure go implementation or auto to use the git binary if its on the PATH")
+	f.BoolVar(&p.IgnoreContextDir, "ignoreContextDir", false, "should we publish every commit of the repository rather than only the commits which change the contextDir of the BuildConfig")
+	f.BoolVarP(&p.ExternalGitUrl, "externalGitUri", "x", false, "should we use the external git URLs when cloning")
+	addSinkFlags(f, p)
+	return cmd
+}
+
+func backfillCommand(cmd *cobra.Command, args []string, p *watcher.WatchFlags, o *watcher.BackfillOptions, cfg *config.Config) error {
+	if len(o.BuildConfig) == 0 {
+		return usageError(cmd, "Please specify the BuildConfig to republish with --buildconfig")
+	}
+	initSchema()
+
+	f := cmdutil.NewFactory(nil)
+	f.BindFlags(cmd.PersistentFlags())
+
+	c, clientConfig := client.NewClient(f)
+	oc, _ := client.NewOpenShiftClient(clientConfig)
+
+	defaultNamespace, _, err := f.DefaultNamespace()
+	if err != nil {
+		return err
+	}
+	if cfg != nil && len(cfg.Sinks) > 0 {
+		p.Sinks, err = cfg.NewSinks(c, defaultNamespace)
+		if err != nil {
+			return err
+		}
+	}
+	if len(o.Namespace) == 0 {
+		o.Namespace = defaultNamespace
+	}
+
+	// lets kill any running git commands if we are stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-term
+		util.Info("Received SIGTERM, stopping the backfill...\n")
+		cancel()
+	}()
+
+	count, err := watcher.RunBackfill(ctx, c, oc, p, o)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Republished %d commits of BuildConfig %s in namespace %s\n", count, o.BuildConfig, o.Namespace)
+	return nil
+}
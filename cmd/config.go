@@ -0,0 +1,121 @@
+//  Copyright 2016 Red Hat, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fabric8io/gitcollector/pkg/config"
+	"github.com/fabric8io/gitcollector/pkg/watcher"
+	"github.com/spf13/pflag"
+)
+
+// applyConfig loads the configuration file and sets the flags which were not given
+// on the command line to its values so that flags override the file. Only the flags
+// of the command are set, other than the ignored flags which mean something else to it
+func applyConfig(f *pflag.FlagSet, fileName string, ignore ...string) (*config.Config, error) {
+	cfg, err := config.Load(fileName, validateWatchConfig)
+	if err != nil {
+		return nil, err
+	}
+	values := []struct {
+		flag  string
+		value string
+	}{
+		{"workdir", cfg.WorkDir},
+		{"namespaces", strings.Join(cfg.Namespaces, ",")},
+		{"namespaceSelector", cfg.NamespaceSelector},
+		{"allNamespaces", formatBool(cfg.AllNamespaces)},
+		{"followProjects", formatBool(cfg.FollowProjects)},
+		{"externalGitUri", formatBool(cfg.ExternalGitURI)},
+		{"buildConfigSelector", cfg.Filters.BuildConfigSelector},
+		{"ignoreContextDir", formatBool(cfg.Filters.IgnoreContextDir)},
+		{"workers", formatInt(cfg.Polling.Workers)},
+		{"resyncPeriod", formatDuration(cfg.Polling.ResyncPeriod)},
+		{"pollInterval", formatDuration(cfg.Polling.PollInterval)},
+		{"maxPollInterval", formatDuration(cfg.Polling.MaxPollInterval)},
+		{"failureBackoff", formatDuration(cfg.Polling.FailureBackoff)},
+		{"maxFailureBackoff", formatDuration(cfg.Polling.MaxFailureBackoff)},
+		{"recentBuildPeriod", formatDuration(cfg.Polling.RecentBuildPeriod)},
+		{"cloneTimeout", formatDuration(cfg.Limits.CloneTimeout)},
+		{"fetchTimeout", formatDuration(cfg.Limits.FetchTimeout)},
+		{"readTimeout", formatDuration(cfg.Limits.ReadTimeout)},
+		{"diskQuota", cfg.Limits.DiskQuota},
+		{"namespaceDiskQuota", cfg.Limits.NamespaceDiskQuota},
+		{"cloneDepth", formatInt(cfg.Limits.CloneDepth)},
+		{"blobless", formatBool(cfg.Limits.Blobless)},
+		{"backfill", cfg.Limits.Backfill},
+		{"batchSize", formatInt(cfg.Limits.BatchSize)},
+		{"publishRetryBackoff", formatDuration(cfg.Publishing.RetryBackoff)},
+		{"maxPublishRetryBackoff", formatDuration(cfg.Publishing.MaxRetryBackoff)},
+		{"commitRetention", cfg.Publishing.CommitRetention},
+	}
+	ignored := map[string]bool{}
+	for _, flag := range ignore {
+		ignored[flag] = true
+	}
+	for _, v := range values {
+		if len(v.value) == 0 || f.Lookup(v.flag) == nil || ignored[v.flag] || f.Changed(v.flag) {
+			continue
+		}
+		err = f.Set(v.flag, v.value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to apply %s from the configuration file %s due to %v", v.flag, fileName, err)
+		}
+	}
+	return cfg, nil
+}
+
+// validateWatchConfig returns the problems with the values of the configuration file which
+// are parsed by the watcher
+func validateWatchConfig(c *config.Config) []string {
+	problems := []string{}
+	if len(c.Limits.Backfill) > 0 {
+		if _, err := watcher.ParseBackfill(c.Limits.Backfill); err != nil {
+			problems = append(problems, fmt.Sprintf("limits.backfill: %v", err))
+		}
+	}
+	switch c.Publishing.CommitRetention {
+	case "", watcher.CommitRetentionDelete, watcher.CommitRetentionKeep:
+	default:
+		problems = append(problems, fmt.Sprintf("publishing.commitRetention: unknown retention %s as it should be %s or %s", c.Publishing.CommitRetention, watcher.CommitRetentionDelete, watcher.CommitRetentionKeep))
+	}
+	return problems
+}
+
+// the values missing from the file are left out so that the defaults of the flags are used for them
+
+func formatBool(value *bool) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*value)
+}
+
+func formatInt(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+func formatDuration(value config.Duration) string {
+	if value.Duration == 0 {
+		return ""
+	}
+	return value.String()
+}
@@ -20,12 +20,16 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fabric8io/gitcollector/pkg/client"
+	"github.com/fabric8io/gitcollector/pkg/config"
 	"github.com/fabric8io/gitcollector/pkg/util"
 	"github.com/fabric8io/gitcollector/pkg/watcher"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
+	"k8s.io/kubernetes/pkg/api/resource"
 	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
 )
 
@@ -35,23 +39,118 @@ func init() {
 
 func newOperateCommand() *cobra.Command {
 	p := &watcher.WatchFlags{}
+	quota := &diskQuotaFlags{}
+	backfill := ""
+	configFile := ""
 	cmd := &cobra.Command{
 		Use:   "operate",
 		Short: "Runs the gitcollector operator",
 		Long:  `This command will startup the operator for the git collector`,
 		Run: func(cmd *cobra.Command, args []string) {
-			err := operateCommand(cmd, args, p)
+			var cfg *config.Config
+			var err error
+			if len(configFile) > 0 {
+				cfg, err = applyConfig(cmd.Flags(), configFile)
+			}
+			if err == nil {
+				err = quota.apply(&p.DiskQuota)
+			}
+			if err == nil {
+				p.Backfill, err = watcher.ParseBackfill(backfill)
+			}
+			if err == nil {
+				err = p.Validate()
+			}
+			if err == nil {
+				err = operateCommand(cmd, args, p, cfg)
+			}
 			handleError(err)
 		},
 	}
 	f := cmd.Flags()
+	f.StringVar(&configFile, "config", "", "a YAML or JSON configuration file of the sinks, namespaces, filters, polling and limits; flags override its values")
 	f.StringVarP(&p.WorkDir, "workdir", "w", "./workdir", "the directory to store work files like git clones")
 	f.StringVarP(&p.Namespace, "namespace", "n", "", "the namespace to watch")
+	f.StringSliceVar(&p.Namespaces, "namespaces", []string{}, "a comma separated list of namespaces to watch")
+	f.StringVarP(&p.NamespaceSelector, "namespaceSelector", "l", "", "a label selector of the namespaces to watch")
+	f.BoolVar(&p.AllNamespaces, "allNamespaces", false, "should we watch the BuildConfigs in all namespaces")
+	f.BoolVar(&p.FollowProjects, "followProjects", false, "should we watch the BuildConfigs of every project we can see as projects are created and deleted")
+	f.StringVar(&p.BuildConfigSelector, "buildConfigSelector", "", "a label selector of the BuildConfigs to collect")
+	f.DurationVar(&p.ResyncPeriod, "resyncPeriod", 5*time.Minute, "how often we relist the BuildConfigs to reconcile any missed watch events")
+	f.IntVar(&p.Workers, "workers", 4, "the number of workers which process the git repositories in parallel")
+	f.DurationVar(&p.Schedule.PollInterval, "pollInterval", 30*time.Second, "how often we poll git repositories with new commits or recent builds")
+	f.DurationVar(&p.Schedule.MaxPollInterval, "maxPollInterval", 10*time.Minute, "the maximum interval idle git repositories back off to")
+	f.DurationVar(&p.Schedule.FailureBackoff, "failureBackoff", 1*time.Minute, "the initial delay before retrying a git repository which failed")
+	f.DurationVar(&p.Schedule.MaxFailureBackoff, "maxFailureBackoff", 30*time.Minute, "the maximum delay before retrying a git repository which keeps failing")
+	f.DurationVar(&p.Schedule.RecentBuildPeriod, "recentBuildPeriod", 1*time.Hour, "how long after a build a git repository keeps being polled every poll interval")
+	f.DurationVar(&p.GitTimeouts.Clone, "cloneTimeout", 10*time.Minute, "how long a git clone can take before it is killed")
+	f.DurationVar(&p.GitTimeouts.Fetch, "fetchTimeout", 5*time.Minute, "how long a git fetch can take before it is killed")
+	f.DurationVar(&p.GitTimeouts.Read, "readTimeout", 1*time.Minute, "how long reading the history of a git clone can take before it is killed")
+	f.StringVar(&quota.total, "diskQuota", "", "the maximum disk space used by the git mirrors in the workdir such as 10Gi; the least recently used mirrors are evicted when its exceeded")
+	f.StringVar(&quota.namespace, "namespaceDiskQuota", "", "the maximum disk space used by the git mirrors of the BuildConfigs in each namespace such as 1Gi")
+	f.IntVar(&p.Clone.Depth, "cloneDepth", 0, "create shallow clones with this many commits; 0 clones the full history")
+	f.BoolVar(&p.Clone.Blobless, "blobless", false, "create partial clones without file contents which need git 2.19 or later on the server and the exec git backend")
+	f.StringVar(&backfill, "backfill", "10", "how much history is published the first time a BuildConfig is collected: all, a number of commits or a date such as 2017-01-31")
+	f.IntVar(&p.BatchSize, "batchSize", 10, "the maximum number of commits published for a BuildConfig each time its git repository is polled")
+	f.StringVar(&p.StateStore, "stateStore", "file", "where to persist the last collected commit of each BuildConfig: file, configmap or none")
+	f.StringVar(&p.StateConfigMap, "stateConfigMap", "gitcollector-state", "the name of the ConfigMap used by the configmap state store")
+	f.StringVar(&p.StateNamespace, "stateNamespace", "", "the namespace of the ConfigMap used by the configmap state store. Defaults to the current namespace")
+	f.StringVar(&p.GitBackend, "gitBackend", "auto", "how git repositories are cloned: exec to use the git binary, go-git to use the pure go implementation or auto to use the git binary if its on the PATH")
+	f.BoolVar(&p.IgnoreContextDir, "ignoreContextDir", false, "should we publish every commit of the repository rather than only the commits which change the contextDir of each BuildConfig")
 	f.BoolVarP(&p.ExternalGitUrl, "externalGitUri", "x", false, "should we use the external git URLs when cloning")
+	f.DurationVar(&p.PublishRetry.Backoff, "publishRetryBackoff", 1*time.Second, "the initial delay before retrying a publish which failed")
+	f.DurationVar(&p.PublishRetry.MaxBackoff, "maxPublishRetryBackoff", 5*time.Minute, "the maximum delay before retrying a publish which keeps failing")
+	f.StringVar(&p.CommitRetention, "commitRetention", watcher.CommitRetentionDelete, "whether the published commits of a BuildConfig are deleted from the sinks or kept when it is deleted or its git source changes: delete or keep")
+	f.StringVar(&p.MetricsAddress, "metricsAddress", "", "the address to serve Prometheus metrics such as the depth of the publish outbox on, such as :9090")
+	addSinkFlags(f, p)
 	return cmd
 }
 
-func operateCommand(cmd *cobra.Command, args []string, p *watcher.WatchFlags) error {
+// addSinkFlags adds the flags which configure the sinks found from the environment variables
+func addSinkFlags(f *pflag.FlagSet, p *watcher.WatchFlags) {
+	h := &p.SinkHTTP
+	f.DurationVar(&h.Timeout, "sinkTimeout", 30*time.Second, "how long each request to a sink can take before it fails and is retried")
+	f.StringVar(&h.Auth.BearerTokenFile, "sinkBearerTokenFile", "", "a file containing the bearer token sent to the sinks which is reread for each request")
+	f.BoolVar(&h.Auth.ServiceAccountToken, "sinkServiceAccountToken", false, "should we send the token of the service account of the pod to the sinks as a bearer token")
+	f.StringVar(&h.TLS.CAFile, "sinkCAFile", "", "a PEM bundle of the certificate authorities trusted when connecting to the sinks with https")
+	f.StringVar(&h.TLS.CertFile, "sinkCertFile", "", "the PEM client certificate presented to the sinks")
+	f.StringVar(&h.TLS.KeyFile, "sinkKeyFile", "", "the PEM key of the client certificate presented to the sinks")
+	f.BoolVar(&p.WIT.PublishRewrites, "witPublishRewrites", false, "should we PUT history rewritten events to the /api/userspace/git/rewrites endpoint of the Work Item Tracker")
+	f.BoolVar(&p.WIT.DeleteCommits, "witDeleteCommits", false, "should we DELETE the commits of a BuildConfig from the Work Item Tracker when they are not retained")
+	f.StringVar(&p.Elasticsearch.BuildConfigIndex, "esBuildConfigIndex", "gitcollector-buildconfigs", "the Elasticsearch index the BuildConfigs are stored in")
+	f.StringVar(&p.Elasticsearch.CommitIndex, "esCommitIndex", "gitcollector-commits", "the Elasticsearch index the git commits are stored in")
+	f.StringVar(&p.Elasticsearch.RewriteIndex, "esRewriteIndex", "gitcollector-rewrites", "the Elasticsearch index the history rewritten events are stored in")
+	f.IntVar(&p.Elasticsearch.BulkSize, "esBulkSize", 500, "the maximum number of documents in each Elasticsearch _bulk request")
+}
+
+// diskQuotaFlags are the disk quota flags which are quantities like 10Gi
+type diskQuotaFlags struct {
+	total     string
+	namespace string
+}
+
+func (q *diskQuotaFlags) apply(quota *watcher.DiskQuota) error {
+	var err error
+	quota.Total, err = parseBytes("diskQuota", q.total)
+	if err != nil {
+		return err
+	}
+	quota.Namespace, err = parseBytes("namespaceDiskQuota", q.namespace)
+	return err
+}
+
+func parseBytes(flag string, text string) (int64, error) {
+	if len(text) == 0 {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(text)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid --%s value %s due to %v", flag, text, err)
+	}
+	return q.Value(), nil
+}
+
+func operateCommand(cmd *cobra.Command, args []string, p *watcher.WatchFlags, cfg *config.Config) error {
 	fmt.Println("gitcollector operator is starting")
 
 	initSchema()
@@ -59,15 +158,24 @@ func operateCommand(cmd *cobra.Command, args []string, p *watcher.WatchFlags) er
 	f := cmdutil.NewFactory(nil)
 	f.BindFlags(cmd.PersistentFlags())
 
-	c, cfg := client.NewClient(f)
-	oc, _ := client.NewOpenShiftClient(cfg)
+	c, clientConfig := client.NewClient(f)
+	oc, _ := client.NewOpenShiftClient(clientConfig)
 
-	if len(p.Namespace) == 0 {
-		n, _, err := f.DefaultNamespace()
+	defaultNamespace, _, err := f.DefaultNamespace()
+	if err != nil {
+		return err
+	}
+	if cfg != nil && len(cfg.Sinks) > 0 {
+		p.Sinks, err = cfg.NewSinks(c, defaultNamespace)
 		if err != nil {
 			return err
 		}
-		p.Namespace = n
+	}
+	if len(p.Namespace) == 0 && len(p.Namespaces) == 0 && len(p.NamespaceSelector) == 0 && !p.AllNamespaces && !p.FollowProjects {
+		p.Namespace = defaultNamespace
+	}
+	if len(p.StateNamespace) == 0 {
+		p.StateNamespace = defaultNamespace
 	}
 	bw := watcher.New(c, oc, p)
 
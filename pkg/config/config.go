@@ -0,0 +1,488 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/publisher"
+	"github.com/ghodss/yaml"
+	"k8s.io/kubernetes/pkg/api/resource"
+	k8sclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/labels"
+)
+
+const (
+	SinkTypeWIT           = "wit"
+	SinkTypeElasticsearch = "elasticsearch"
+
+	defaultUsernameKey = "username"
+	defaultPasswordKey = "password"
+)
+
+// Config is the YAML or JSON configuration file of the operator. Any flags
+// given on the command line override the values in the file.
+//
+// The booleans and numbers are pointers so that false and 0 can be told apart
+// from values which are not in the file and so use the defaults of the flags
+type Config struct {
+	WorkDir           string     `json:"workdir,omitempty"`
+	Namespaces        []string   `json:"namespaces,omitempty"`
+	NamespaceSelector string     `json:"namespaceSelector,omitempty"`
+	AllNamespaces     *bool      `json:"allNamespaces,omitempty"`
+	FollowProjects    *bool      `json:"followProjects,omitempty"`
+	ExternalGitURI    *bool      `json:"externalGitUri,omitempty"`
+	Filters           Filters    `json:"filters,omitempty"`
+	Polling           Polling    `json:"polling,omitempty"`
+	Limits            Limits     `json:"limits,omitempty"`
+	Publishing        Publishing `json:"publishing,omitempty"`
+	Sinks             []Sink     `json:"sinks,omitempty"`
+}
+
+// Filters are which BuildConfigs and commits are collected
+type Filters struct {
+	BuildConfigSelector string `json:"buildConfigSelector,omitempty"`
+	IgnoreContextDir    *bool  `json:"ignoreContextDir,omitempty"`
+}
+
+// Polling is how often the BuildConfigs and their git repositories are polled
+type Polling struct {
+	Workers           *int     `json:"workers,omitempty"`
+	ResyncPeriod      Duration `json:"resyncPeriod,omitempty"`
+	PollInterval      Duration `json:"pollInterval,omitempty"`
+	MaxPollInterval   Duration `json:"maxPollInterval,omitempty"`
+	FailureBackoff    Duration `json:"failureBackoff,omitempty"`
+	MaxFailureBackoff Duration `json:"maxFailureBackoff,omitempty"`
+	RecentBuildPeriod Duration `json:"recentBuildPeriod,omitempty"`
+}
+
+// Limits bound the time, disk space and history used for each git repository
+type Limits struct {
+	CloneTimeout       Duration `json:"cloneTimeout,omitempty"`
+	FetchTimeout       Duration `json:"fetchTimeout,omitempty"`
+	ReadTimeout        Duration `json:"readTimeout,omitempty"`
+	DiskQuota          string   `json:"diskQuota,omitempty"`
+	NamespaceDiskQuota string   `json:"namespaceDiskQuota,omitempty"`
+	CloneDepth         *int     `json:"cloneDepth,omitempty"`
+	Blobless           *bool    `json:"blobless,omitempty"`
+	Backfill           string   `json:"backfill,omitempty"`
+	BatchSize          *int     `json:"batchSize,omitempty"`
+}
+
+// Publishing is how failed publishes are retried and how long commits are kept
+type Publishing struct {
+	RetryBackoff    Duration `json:"retryBackoff,omitempty"`
+	MaxRetryBackoff Duration `json:"maxRetryBackoff,omitempty"`
+	CommitRetention string   `json:"commitRetention,omitempty"`
+}
+
+// Sink is a destination the BuildConfigs and commits are published to
+type Sink struct {
+	// Name defaults to the type and must be unique as it names the outbox of the sink
+	Name          string                          `json:"name,omitempty"`
+	Type          string                          `json:"type"`
+	URL           string                          `json:"url"`
+	Auth          Auth                            `json:"auth,omitempty"`
+	TLS           publisher.TLSOptions            `json:"tls,omitempty"`
+	Timeout       Duration                        `json:"timeout,omitempty"`
+	WIT           *publisher.WITOptions           `json:"wit,omitempty"`
+	Elasticsearch *publisher.ElasticsearchOptions `json:"elasticsearch,omitempty"`
+}
+
+// Auth is the credentials of a sink where the username and password can also be read from a secret
+type Auth struct {
+	publisher.AuthOptions
+	BasicAuthSecret *SecretRef `json:"basicAuthSecret,omitempty"`
+}
+
+// SecretRef is a kubernetes secret holding a username and password
+type SecretRef struct {
+	// Namespace defaults to the namespace of the operator
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+	UsernameKey string `json:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// name returns the name of the sink defaulting to its type
+func (s *Sink) name() string {
+	if len(s.Name) > 0 {
+		return s.Name
+	}
+	return s.Type
+}
+
+// Duration is a time.Duration written like 30s or 5m
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return fmt.Errorf("durations should be a string like 30s or 5m but was %s", string(data))
+	}
+	d.Duration, err = time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s as it should be like 30s or 5m", text)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Validator returns the problems with the values of the configuration used by
+// other packages, each starting with the path of the invalid field
+type Validator func(c *Config) []string
+
+// Load loads and validates the configuration file reporting the problems found by
+// Validate and the given validators together
+func Load(fileName string, validators ...Validator) (*Config, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the configuration file %s due to %v", fileName, err)
+	}
+	// YAML is converted to JSON so that JSON files are also supported and the json tags are used
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the configuration file %s due to %v", fileName, err)
+	}
+	var values interface{}
+	err = json.Unmarshal(jsonData, &values)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the configuration file %s due to %v", fileName, err)
+	}
+	problems := unknownFields(values, reflect.TypeOf(Config{}), "")
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid configuration file %s:\n  %s", fileName, strings.Join(problems, "\n  "))
+	}
+	config := &Config{}
+	err = json.Unmarshal(jsonData, config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the configuration file %s due to %v", fileName, err)
+	}
+	problems = config.Validate()
+	for _, validator := range validators {
+		problems = append(problems, validator(config)...)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid configuration file %s:\n  %s", fileName, strings.Join(problems, "\n  "))
+	}
+	return config, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// unknownFields returns the problems for the fields of the decoded JSON which are not fields
+// of the type, each starting with its path, so that typos are reported rather than ignored
+func unknownFields(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+	problems := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			// values of the wrong type are reported when decoding
+			return nil
+		}
+		fields := jsonFields(t)
+		keys := []string{}
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := key
+			if len(path) > 0 {
+				field = path + "." + key
+			}
+			// like encoding/json the names are matched ignoring case
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				problems = append(problems, field+": unknown field")
+				continue
+			}
+			problems = append(problems, unknownFields(object[key], fieldType, field)...)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			problems = append(problems, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+// jsonFields returns the types of the fields of the struct by their lower case JSON names
+// including the fields of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	answer := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range jsonFields(f.Type) {
+				answer[embeddedName] = embeddedType
+			}
+			continue
+		}
+		if len(f.PkgPath) > 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		answer[strings.ToLower(name)] = f.Type
+	}
+	return answer
+}
+
+// Validate returns the problems with the configuration each starting with the path of the invalid field
+func (c *Config) Validate() []string {
+	problems := []string{}
+	add := func(field string, format string, args ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.AllNamespaces != nil && *c.AllNamespaces && (len(c.Namespaces) > 0 || len(c.NamespaceSelector) > 0) {
+		add("allNamespaces", "can't be combined with namespaces or namespaceSelector")
+	}
+	for i, ns := range c.Namespaces {
+		if len(strings.TrimSpace(ns)) == 0 {
+			add(fmt.Sprintf("namespaces[%d]", i), "can't be empty")
+		}
+	}
+	selectors := []struct {
+		field string
+		value string
+	}{
+		{"namespaceSelector", c.NamespaceSelector},
+		{"filters.buildConfigSelector", c.Filters.BuildConfigSelector},
+	}
+	for _, selector := range selectors {
+		if len(selector.value) > 0 {
+			if _, err := labels.Parse(selector.value); err != nil {
+				add(selector.field, "invalid label selector %s due to %v", selector.value, err)
+			}
+		}
+	}
+
+	p := &c.Polling
+	if p.Workers != nil && *p.Workers < 0 {
+		add("polling.workers", "can't be negative")
+	}
+	durations := []struct {
+		field string
+		value Duration
+	}{
+		{"polling.resyncPeriod", p.ResyncPeriod},
+		{"polling.pollInterval", p.PollInterval},
+		{"polling.maxPollInterval", p.MaxPollInterval},
+		{"polling.failureBackoff", p.FailureBackoff},
+		{"polling.maxFailureBackoff", p.MaxFailureBackoff},
+		{"polling.recentBuildPeriod", p.RecentBuildPeriod},
+		{"limits.cloneTimeout", c.Limits.CloneTimeout},
+		{"limits.fetchTimeout", c.Limits.FetchTimeout},
+		{"limits.readTimeout", c.Limits.ReadTimeout},
+		{"publishing.retryBackoff", c.Publishing.RetryBackoff},
+		{"publishing.maxRetryBackoff", c.Publishing.MaxRetryBackoff},
+	}
+	for _, d := range durations {
+		if d.value.Duration < 0 {
+			add(d.field, "can't be negative")
+		}
+	}
+	if p.MaxPollInterval.Duration > 0 && p.MaxPollInterval.Duration < p.PollInterval.Duration {
+		add("polling.maxPollInterval", "can't be less than the pollInterval %v", p.PollInterval)
+	}
+	if p.MaxFailureBackoff.Duration > 0 && p.MaxFailureBackoff.Duration < p.FailureBackoff.Duration {
+		add("polling.maxFailureBackoff", "can't be less than the failureBackoff %v", p.FailureBackoff)
+	}
+	r := &c.Publishing
+	if r.MaxRetryBackoff.Duration > 0 && r.MaxRetryBackoff.Duration < r.RetryBackoff.Duration {
+		add("publishing.maxRetryBackoff", "can't be less than the retryBackoff %v", r.RetryBackoff)
+	}
+
+	l := &c.Limits
+	quotas := []struct {
+		field string
+		value string
+	}{
+		{"limits.diskQuota", l.DiskQuota},
+		{"limits.namespaceDiskQuota", l.NamespaceDiskQuota},
+	}
+	for _, quota := range quotas {
+		if len(quota.value) > 0 {
+			if q, err := resource.ParseQuantity(quota.value); err != nil {
+				add(quota.field, "invalid quantity %s as it should be like 10Gi", quota.value)
+			} else if q.Value() < 0 {
+				add(quota.field, "can't be negative")
+			}
+		}
+	}
+	if l.CloneDepth != nil && *l.CloneDepth < 0 {
+		add("limits.cloneDepth", "can't be negative")
+	}
+	if l.BatchSize != nil && *l.BatchSize < 0 {
+		add("limits.batchSize", "can't be negative")
+	}
+
+	names := map[string]bool{}
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		field := fmt.Sprintf("sinks[%d]", i)
+		switch s.Type {
+		case SinkTypeWIT:
+			if s.Elasticsearch != nil {
+				add(field+".elasticsearch", "can only be used with sinks of type %s", SinkTypeElasticsearch)
+			}
+		case SinkTypeElasticsearch:
+			if s.WIT != nil {
+				add(field+".wit", "can only be used with sinks of type %s", SinkTypeWIT)
+			}
+		case "":
+			add(field+".type", "is required and should be %s or %s", SinkTypeWIT, SinkTypeElasticsearch)
+		default:
+			add(field+".type", "unknown type %s as it should be %s or %s", s.Type, SinkTypeWIT, SinkTypeElasticsearch)
+		}
+		name := strings.ToLower(s.name())
+		if len(name) > 0 {
+			if names[name] {
+				add(field+".name", "the name %s is already used by another sink", s.name())
+			}
+			names[name] = true
+		}
+		u, err := url.Parse(s.URL)
+		if len(s.URL) == 0 {
+			add(field+".url", "is required")
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			add(field+".url", "%s should be an absolute http or https URL", s.URL)
+		}
+		if err := s.Auth.Validate(); err != nil {
+			add(field+".auth", "%v", err)
+		} else if secret := s.Auth.BasicAuthSecret; secret != nil {
+			if len(secret.Name) == 0 {
+				add(field+".auth.basicAuthSecret.name", "is required")
+			}
+			if s.Auth.AuthOptions != (publisher.AuthOptions{}) {
+				add(field+".auth.basicAuthSecret", "can't be combined with other credentials")
+			}
+		}
+		if err := s.TLS.Validate(); err != nil {
+			add(field+".tls", "%v", err)
+		}
+		if s.Timeout.Duration < 0 {
+			add(field+".timeout", "can't be negative")
+		}
+		if es := s.Elasticsearch; es != nil && es.BulkSize < 0 {
+			add(field+".elasticsearch.bulkSize", "can't be negative")
+		}
+	}
+	return problems
+}
+
+// NewSinks creates the sinks in the configuration reading any secrets they use
+// from the given namespace unless they specify their own
+func (c *Config) NewSinks(client *k8sclient.Client, namespace string) ([]publisher.Sink, error) {
+	answer := []publisher.Sink{}
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		auth, err := s.Auth.resolve(client, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sink %s due to %v", s.name(), err)
+		}
+		options := publisher.HTTPOptions{
+			Auth:    auth,
+			TLS:     s.TLS,
+			Timeout: s.Timeout.Duration,
+		}
+		var sink publisher.Sink
+		switch s.Type {
+		case SinkTypeWIT:
+			witOptions := publisher.WITOptions{}
+			if s.WIT != nil {
+				witOptions = *s.WIT
+			}
+			sink, err = publisher.NewWITSink(s.name(), s.URL, options, witOptions)
+		case SinkTypeElasticsearch:
+			esOptions := publisher.ElasticsearchOptions{}
+			if s.Elasticsearch != nil {
+				esOptions = *s.Elasticsearch
+			}
+			sink, err = publisher.NewElasticsearchSink(s.name(), s.URL, options, esOptions)
+		default:
+			err = fmt.Errorf("unknown type %s", s.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sink %s due to %v", s.name(), err)
+		}
+		answer = append(answer, sink)
+	}
+	return answer, nil
+}
+
+// resolve returns the credentials reading the username and password from the secret if there is one.
+// The secret is only read at startup so the operator must be restarted when it changes
+func (a *Auth) resolve(client *k8sclient.Client, namespace string) (publisher.AuthOptions, error) {
+	ref := a.BasicAuthSecret
+	if ref == nil {
+		return a.AuthOptions, nil
+	}
+	if len(ref.Namespace) > 0 {
+		namespace = ref.Namespace
+	}
+	secret, err := client.Secrets(namespace).Get(ref.Name)
+	if err != nil {
+		return publisher.AuthOptions{}, fmt.Errorf("failed to read the secret %s in namespace %s due to %v", ref.Name, namespace, err)
+	}
+	usernameKey := ref.UsernameKey
+	if len(usernameKey) == 0 {
+		usernameKey = defaultUsernameKey
+	}
+	passwordKey := ref.PasswordKey
+	if len(passwordKey) == 0 {
+		passwordKey = defaultPasswordKey
+	}
+	username := string(secret.Data[usernameKey])
+	if len(username) == 0 {
+		return publisher.AuthOptions{}, fmt.Errorf("the secret %s in namespace %s has no %s", ref.Name, namespace, usernameKey)
+	}
+	return publisher.AuthOptions{
+		Username: username,
+		Password: string(secret.Data[passwordKey]),
+	}, nil
+}
@@ -0,0 +1,334 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfig writes the configuration file into a temporary directory returning its name
+func writeConfig(t *testing.T, text string) (string, func()) {
+	dir, err := ioutil.TempDir("", "gitcollector-config-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	fileName := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(fileName, []byte(text), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v", fileName, err)
+	}
+	return fileName, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fileName, cleanup := writeConfig(t, `
+workdir: /data
+namespaces: [myproject, other]
+allNamespaces: false
+externalGitUri: true
+polling:
+  workers: 0
+  pollInterval: 30s
+  maxPollInterval: 5m
+limits:
+  cloneDepth: 0
+  blobless: false
+  backfill: all
+publishing:
+  retryBackoff: 2s
+sinks:
+- type: elasticsearch
+  url: http://elasticsearch:9200
+  timeout: 10s
+  elasticsearch:
+    bulkSize: 100
+- type: wit
+  name: WIT
+  url: https://api.openshift.io/api
+  auth:
+    serviceAccountToken: true
+  wit:
+    publishRewrites: true
+`)
+	defer cleanup()
+	config, err := Load(fileName)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/data", config.WorkDir)
+	assert.Equal(t, []string{"myproject", "other"}, config.Namespaces)
+	// false and 0 are kept so they can override the defaults of the flags
+	if assert.NotNil(t, config.AllNamespaces) {
+		assert.False(t, *config.AllNamespaces)
+	}
+	assert.Nil(t, config.FollowProjects)
+	if assert.NotNil(t, config.ExternalGitURI) {
+		assert.True(t, *config.ExternalGitURI)
+	}
+	if assert.NotNil(t, config.Polling.Workers) {
+		assert.Equal(t, 0, *config.Polling.Workers)
+	}
+	assert.Equal(t, 30*time.Second, config.Polling.PollInterval.Duration)
+	assert.Equal(t, 5*time.Minute, config.Polling.MaxPollInterval.Duration)
+	assert.Equal(t, time.Duration(0), config.Polling.ResyncPeriod.Duration)
+	if assert.NotNil(t, config.Limits.CloneDepth) {
+		assert.Equal(t, 0, *config.Limits.CloneDepth)
+	}
+	if assert.NotNil(t, config.Limits.Blobless) {
+		assert.False(t, *config.Limits.Blobless)
+	}
+	assert.Nil(t, config.Limits.BatchSize)
+	assert.Equal(t, "all", config.Limits.Backfill)
+	assert.Equal(t, 2*time.Second, config.Publishing.RetryBackoff.Duration)
+	if assert.Len(t, config.Sinks, 2) {
+		es := config.Sinks[0]
+		assert.Equal(t, SinkTypeElasticsearch, es.name())
+		assert.Equal(t, 10*time.Second, es.Timeout.Duration)
+		if assert.NotNil(t, es.Elasticsearch) {
+			assert.Equal(t, 100, es.Elasticsearch.BulkSize)
+		}
+		wit := config.Sinks[1]
+		assert.Equal(t, "WIT", wit.name())
+		assert.True(t, wit.Auth.ServiceAccountToken)
+		if assert.NotNil(t, wit.WIT) {
+			assert.True(t, wit.WIT.PublishRewrites)
+			assert.False(t, wit.WIT.DeleteCommits)
+		}
+	}
+}
+
+func TestLoadReportsProblems(t *testing.T) {
+	tests := []struct {
+		name       string
+		text       string
+		validators []Validator
+		expected   string
+	}{
+		{
+			name:     "invalid YAML",
+			text:     "namespaces: [myproject",
+			expected: "Failed to parse the configuration file",
+		},
+		{
+			name:     "unknown field",
+			text:     "polling:\n  pollIntervall: 30s\n",
+			expected: "polling.pollIntervall: unknown field",
+		},
+		{
+			name:     "wrong type",
+			text:     "polling:\n  workers: many\n",
+			expected: "Failed to parse the configuration file",
+		},
+		{
+			name:     "invalid duration",
+			text:     "polling:\n  pollInterval: 30 seconds\n",
+			expected: "invalid duration 30 seconds",
+		},
+		{
+			name:     "invalid value",
+			text:     "limits:\n  cloneDepth: -1\n",
+			expected: "limits.cloneDepth: can't be negative",
+		},
+		{
+			name: "validators",
+			text: "limits:\n  backfill: latest\n",
+			validators: []Validator{
+				func(c *Config) []string {
+					return []string{"limits.backfill: invalid backfill " + c.Limits.Backfill}
+				},
+			},
+			expected: "limits.backfill: invalid backfill latest",
+		},
+	}
+	for _, test := range tests {
+		fileName, cleanup := writeConfig(t, test.text)
+		_, err := Load(fileName, test.validators...)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.expected, test.name)
+		}
+		cleanup()
+	}
+	_, err := Load(filepath.Join(os.TempDir(), "gitcollector-missing", "config.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to read the configuration file")
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "known fields",
+			text:     "workdir: /data\nfilters:\n  ignoreContextDir: true\n",
+			expected: []string{},
+		},
+		{
+			name:     "names are matched ignoring case",
+			text:     "WorkDir: /data\npolling:\n  POLLINTERVAL: 30s\n",
+			expected: []string{},
+		},
+		{
+			name:     "top level field",
+			text:     "workdir: /data\nworkers: 4\n",
+			expected: []string{"workers: unknown field"},
+		},
+		{
+			name:     "nested fields",
+			text:     "polling:\n  interval: 30s\nlimits:\n  depth: 1\n  quota: 1Gi\n",
+			expected: []string{"limits.depth: unknown field", "limits.quota: unknown field", "polling.interval: unknown field"},
+		},
+		{
+			name:     "fields of items",
+			text:     "sinks:\n- type: wit\n  url: http://wit\n- type: elasticsearch\n  uri: http://es\n  elasticsearch:\n    bulk: 10\n",
+			expected: []string{"sinks[1].elasticsearch.bulk: unknown field", "sinks[1].uri: unknown field"},
+		},
+		{
+			name:     "fields of embedded structs",
+			text:     "sinks:\n- type: wit\n  auth:\n    bearerToken: abc\n    token: abc\n    basicAuthSecret:\n      name: creds\n      key: user\n",
+			expected: []string{"sinks[0].auth.basicAuthSecret.key: unknown field", "sinks[0].auth.token: unknown field"},
+		},
+		{
+			name:     "values of the wrong type are left to the decoder",
+			text:     "polling: fast\nsinks: many\npublishing:\n  retryBackoff:\n    seconds: 5\n",
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		var values interface{}
+		err := yaml.Unmarshal([]byte(test.text), &values)
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, test.expected, unknownFields(values, reflect.TypeOf(Config{}), ""), test.name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "empty",
+			text:     "{}",
+			expected: []string{},
+		},
+		{
+			name:     "all namespaces with namespaces",
+			text:     "allNamespaces: true\nnamespaces: [myproject]\n",
+			expected: []string{"allNamespaces: can't be combined with namespaces or namespaceSelector"},
+		},
+		{
+			name:     "not all namespaces with namespaces",
+			text:     "allNamespaces: false\nnamespaces: [myproject]\n",
+			expected: []string{},
+		},
+		{
+			name:     "empty namespace",
+			text:     "namespaces: [myproject, ' ']\n",
+			expected: []string{"namespaces[1]: can't be empty"},
+		},
+		{
+			name: "negative values",
+			text: "polling:\n  workers: -1\n  resyncPeriod: -1m\nlimits:\n  cloneDepth: -1\n  batchSize: -1\npublishing:\n  retryBackoff: -1s\n",
+			expected: []string{
+				"polling.workers: can't be negative",
+				"polling.resyncPeriod: can't be negative",
+				"publishing.retryBackoff: can't be negative",
+				"limits.cloneDepth: can't be negative",
+				"limits.batchSize: can't be negative",
+			},
+		},
+		{
+			name: "maximums less than the minimums",
+			text: "polling:\n  pollInterval: 5m\n  maxPollInterval: 1m\n  failureBackoff: 1m\n  maxFailureBackoff: 30s\npublishing:\n  retryBackoff: 10s\n  maxRetryBackoff: 1s\n",
+			expected: []string{
+				"polling.maxPollInterval: can't be less than the pollInterval 5m0s",
+				"polling.maxFailureBackoff: can't be less than the failureBackoff 1m0s",
+				"publishing.maxRetryBackoff: can't be less than the retryBackoff 10s",
+			},
+		},
+		{
+			name:     "valid sinks",
+			text:     "sinks:\n- type: wit\n  url: http://wit\n- type: elasticsearch\n  url: https://es:9200\n  auth:\n    basicAuthSecret:\n      name: creds\n",
+			expected: []string{},
+		},
+		{
+			name: "sink types",
+			text: "sinks:\n- url: http://a\n- type: kafka\n  url: http://b\n- type: wit\n  name: wit2\n  url: http://c\n  elasticsearch: {}\n- type: elasticsearch\n  url: http://d\n  wit: {}\n",
+			expected: []string{
+				"sinks[0].type: is required and should be wit or elasticsearch",
+				"sinks[1].type: unknown type kafka as it should be wit or elasticsearch",
+				"sinks[2].elasticsearch: can only be used with sinks of type elasticsearch",
+				"sinks[3].wit: can only be used with sinks of type wit",
+			},
+		},
+		{
+			name: "sink names",
+			text: "sinks:\n- type: wit\n  url: http://a\n- type: wit\n  url: http://b\n- type: elasticsearch\n  name: Wit\n  url: http://c\n",
+			expected: []string{
+				"sinks[1].name: the name wit is already used by another sink",
+				"sinks[2].name: the name Wit is already used by another sink",
+			},
+		},
+		{
+			name: "sink URLs",
+			text: "sinks:\n- type: wit\n  name: a\n- type: wit\n  name: b\n  url: ftp://wit\n- type: wit\n  name: c\n  url: /api\n",
+			expected: []string{
+				"sinks[0].url: is required",
+				"sinks[1].url: ftp://wit should be an absolute http or https URL",
+				"sinks[2].url: /api should be an absolute http or https URL",
+			},
+		},
+		{
+			name: "sink credentials",
+			text: "sinks:\n- type: wit\n  name: a\n  url: http://a\n  auth:\n    bearerToken: abc\n    serviceAccountToken: true\n- type: wit\n  name: b\n  url: http://b\n  auth:\n    username: user\n    basicAuthSecret:\n      name: creds\n- type: wit\n  name: c\n  url: http://c\n  auth:\n    basicAuthSecret:\n      usernameKey: user\n",
+			expected: []string{
+				"sinks[0].auth: only one of bearerToken, bearerTokenFile or serviceAccountToken can be used",
+				"sinks[1].auth.basicAuthSecret: can't be combined with other credentials",
+				"sinks[2].auth.basicAuthSecret.name: is required",
+			},
+		},
+		{
+			name: "sink limits",
+			text: "sinks:\n- type: elasticsearch\n  url: http://es\n  timeout: -1s\n  elasticsearch:\n    bulkSize: -1\n",
+			expected: []string{
+				"sinks[0].timeout: can't be negative",
+				"sinks[0].elasticsearch.bulkSize: can't be negative",
+			},
+		},
+	}
+	for _, test := range tests {
+		config := &Config{}
+		err := yaml.Unmarshal([]byte(test.text), config)
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, test.expected, config.Validate(), test.name)
+		}
+	}
+}
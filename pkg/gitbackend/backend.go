@@ -0,0 +1,211 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+)
+
+const (
+	// Exec uses the git binary
+	Exec = "exec"
+
+	// GoGit uses the pure go implementation of git so that no git binary is required
+	GoGit = "go-git"
+
+	// Auto uses the git binary if it is on the PATH otherwise go-git
+	Auto = "auto"
+)
+
+// Signature is the author or committer of a commit
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// Commit is a commit in the history of a git repository
+type Commit struct {
+	Hash         string
+	Message      string
+	Author       Signature
+	Committer    Signature
+	ParentHashes []string
+}
+
+// Credentials are used to authenticate with the git server
+type Credentials struct {
+	Username      string
+	Password      string
+	SSHPrivateKey []byte
+	KnownHosts    []byte
+	CACert        []byte
+}
+
+// Proxy is the proxy configuration used to access the git server over HTTP
+type Proxy struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// Source is the git repository and ref along with how to connect to it
+type Source struct {
+	URI         string
+	Ref         string
+	Credentials *Credentials
+	Proxy       Proxy
+}
+
+// Options configures how repositories are cloned
+type Options struct {
+	// Depth creates shallow clones with the given number of commits when greater than zero.
+	// Fetches are not shallow so the history from the boundary of the clone is kept
+	Depth int
+
+	// Blobless creates partial clones without any file contents as only the history is needed.
+	// Only supported by the exec backend and servers which support partial clones
+	Blobless bool
+}
+
+// RevListOptions bounds the commits returned by RevList
+type RevListOptions struct {
+	// Limit only returns the newest Limit commits when greater than zero
+	Limit int
+
+	// Since only returns the commits committed at or after this time when not zero
+	Since time.Time
+}
+
+// RefNotFoundError is returned when the ref of a git source can't be found in its clone
+type RefNotFoundError struct {
+	Ref string
+	URI string
+	Err error
+}
+
+func (e *RefNotFoundError) Error() string {
+	ref := e.Ref
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("Could not find the ref %s in %s due to %v", ref, e.URI, e.Err)
+	}
+	return fmt.Sprintf("Could not find the ref %s in %s", ref, e.URI)
+}
+
+// IsRefNotFound returns true if the error is a *RefNotFoundError
+func IsRefNotFound(err error) bool {
+	_, ok := err.(*RefNotFoundError)
+	return ok
+}
+
+// Backend clones and fetches git repositories.
+//
+// Each operation is stopped when the context is cancelled or its deadline expires
+// returning an error saying the operation timed out or was cancelled
+type Backend interface {
+	// Name returns the name of the backend
+	Name() string
+
+	// Clone creates a bare clone of the git repository of the source in the directory
+	// returning a *RefNotFoundError if the ref of the source is not in the clone
+	Clone(ctx context.Context, dir string, source *Source) error
+
+	// Fetch fetches the latest branches and tags into the clone in the directory,
+	// following any upstream history rewrites and pruning the branches and tags which
+	// were deleted upstream. It returns true if any branch or tag changed, along with
+	// a *RefNotFoundError if the ref of the source is no longer there
+	Fetch(ctx context.Context, dir string, source *Source) (bool, error)
+
+	// Validate returns an error if the directory does not contain a clone of the git source,
+	// such as on a persistent volume after a restart, or a *RefNotFoundError if the ref of
+	// the source is not in the clone
+	Validate(ctx context.Context, dir string, source *Source) error
+
+	// Open opens the clone in the directory to read its history; the context
+	// is used for all the operations on the returned Repository
+	Open(ctx context.Context, dir string) (Repository, error)
+}
+
+// Repository reads the history of a clone
+type Repository interface {
+	// ResolveRef returns the commit at the tip of the ref which can be a branch,
+	// a tag or a commit SHA. An empty ref resolves to HEAD
+	ResolveRef(ref string) (*Commit, error)
+
+	// RevList returns the commits reachable from tip which are not reachable from any of the
+	// excluded commits, like `git rev-list tip ^exclude...`, ordered so that parents come before
+	// their children
+	RevList(tip string, exclude []string, options RevListOptions) ([]*Commit, error)
+
+	// HasCommit returns true if the commit is in the repository
+	HasCommit(hash string) bool
+
+	// IsAncestor returns true if the ancestor commit is in the repository and reachable from tip
+	IsAncestor(ancestor string, tip string) bool
+
+	// Diff returns the paths of the files changed by the commit compared to its first parent
+	Diff(commit *Commit) ([]string, error)
+
+	// IsShallow returns true if the repository is a shallow clone so that commits older
+	// than its boundary may be missing
+	IsShallow() bool
+}
+
+// shallowCommits returns the boundary commits of a shallow bare clone, whose parents
+// are not in the clone, or nil if the clone has the full history.
+//
+// RevList treats the boundary commits as excluded as they only look like root commits
+// because their parents were not fetched
+func shallowCommits(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "shallow"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to read the shallow commits of %s due to %v", dir, err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// New returns the backend with the given name
+func New(name string, options Options) (Backend, error) {
+	switch name {
+	case Exec:
+		return NewExecBackend(options), nil
+	case GoGit:
+		return NewGoGitBackend(options), nil
+	case "", Auto:
+		if _, err := exec.LookPath("git"); err == nil {
+			return NewExecBackend(options), nil
+		}
+		util.Infof("Could not find a git binary on the PATH so using %s\n", GoGit)
+		return NewGoGitBackend(options), nil
+	default:
+		return nil, fmt.Errorf("Unknown git backend %s. Supported values are %s, %s or %s", name, Auto, Exec, GoGit)
+	}
+}
@@ -0,0 +1,169 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"srcd.works/go-git.v4/plumbing/transport"
+	githttp "srcd.works/go-git.v4/plumbing/transport/http"
+	gitssh "srcd.works/go-git.v4/plumbing/transport/ssh"
+)
+
+// defaultGitUsername is the user name used for SSH and when a password is supplied without a user name
+const defaultGitUsername = "git"
+
+// gitContext is the extra configuration and environment variables used when running git
+// for a git source along with any temporary files which are removed by cleanup
+type gitContext struct {
+	config  []string
+	env     []string
+	tempDir string
+}
+
+// newGitContext returns the git configuration and environment variables to use the credentials
+// and the proxy of the git source.
+//
+// Any files which git needs such as the SSH private key are written to a temporary
+// directory outside of the work directory which is removed by cleanup.
+// The username and password are passed via environment variables to a credential helper
+// so that they are never written to disk
+func newGitContext(source *Source) (*gitContext, error) {
+	gc := &gitContext{
+		env: source.Proxy.env(),
+	}
+	creds := source.Credentials
+	if creds == nil {
+		return gc, nil
+	}
+	if len(creds.SSHPrivateKey) > 0 {
+		keyFile, err := gc.writeTempFile("id_rsa", creds.SSHPrivateKey)
+		if err != nil {
+			return gc, err
+		}
+		sshCommand := "ssh -i " + shellQuote(keyFile) + " -o IdentitiesOnly=yes"
+		if len(creds.KnownHosts) > 0 {
+			knownHostsFile, err := gc.writeTempFile("known_hosts", creds.KnownHosts)
+			if err != nil {
+				return gc, err
+			}
+			sshCommand += " -o UserKnownHostsFile=" + shellQuote(knownHostsFile) + " -o StrictHostKeyChecking=yes"
+		} else {
+			// like OpenShift builds we don't check the host key unless known_hosts are supplied
+			sshCommand += " -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+		}
+		gc.env = append(gc.env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+	if len(creds.Password) > 0 {
+		username := creds.Username
+		if len(username) == 0 {
+			username = defaultGitUsername
+		}
+		gc.config = append(gc.config,
+			"credential.helper=",
+			"credential.helper=!f() { echo username=\"$GITCOLLECTOR_USERNAME\"; echo password=\"$GITCOLLECTOR_PASSWORD\"; }; f")
+		gc.env = append(gc.env,
+			"GITCOLLECTOR_USERNAME="+username,
+			"GITCOLLECTOR_PASSWORD="+creds.Password,
+			"GIT_TERMINAL_PROMPT=0")
+	}
+	if len(creds.CACert) > 0 {
+		caFile, err := gc.writeTempFile("ca.crt", creds.CACert)
+		if err != nil {
+			return gc, err
+		}
+		gc.env = append(gc.env, "GIT_SSL_CAINFO="+caFile)
+	}
+	return gc, nil
+}
+
+// writeTempFile writes the data to a file only readable by us in the temporary directory
+func (gc *gitContext) writeTempFile(name string, data []byte) (string, error) {
+	if len(gc.tempDir) == 0 {
+		dir, err := ioutil.TempDir("", "gitcollector-")
+		if err != nil {
+			return "", fmt.Errorf("Failed to create temporary directory due to %v", err)
+		}
+		gc.tempDir = dir
+	}
+	fileName := filepath.Join(gc.tempDir, name)
+	err := ioutil.WriteFile(fileName, data, 0600)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write temporary file %s due to %v", fileName, err)
+	}
+	return fileName, nil
+}
+
+// args returns the git arguments prefixed with the configuration
+func (gc *gitContext) args(args []string) []string {
+	answer := []string{}
+	if gc != nil {
+		for _, c := range gc.config {
+			answer = append(answer, "-c", c)
+		}
+	}
+	return append(answer, args...)
+}
+
+// environ returns the environment variables for the git process
+func (gc *gitContext) environ() []string {
+	if gc == nil || len(gc.env) == 0 {
+		return nil
+	}
+	return append(os.Environ(), gc.env...)
+}
+
+// cleanup removes any temporary files
+func (gc *gitContext) cleanup() {
+	if gc != nil && len(gc.tempDir) > 0 {
+		os.RemoveAll(gc.tempDir)
+		gc.tempDir = ""
+	}
+}
+
+// authMethod returns the go-git authentication for the given git URI. As go-git can't verify
+// host keys against known_hosts or trust a custom CA for a single repository an error is
+// returned if either is supplied rather than silently connecting without them
+func (creds *Credentials) authMethod(uri string) (transport.AuthMethod, error) {
+	if creds == nil {
+		return nil, nil
+	}
+	if len(creds.KnownHosts) > 0 {
+		return nil, fmt.Errorf("known_hosts in the source secret is not supported by the go-git backend; use --gitBackend=exec")
+	}
+	if len(creds.CACert) > 0 {
+		return nil, fmt.Errorf("ca.crt in the source secret is not supported by the go-git backend; use --gitBackend=exec")
+	}
+	if len(creds.SSHPrivateKey) > 0 && !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		return gitssh.NewPublicKeys(defaultGitUsername, creds.SSHPrivateKey, "")
+	}
+	if len(creds.Password) > 0 {
+		username := creds.Username
+		if len(username) == 0 {
+			username = defaultGitUsername
+		}
+		return githttp.NewBasicAuth(username, creds.Password), nil
+	}
+	return nil, nil
+}
+
+func shellQuote(text string) string {
+	return "'" + strings.Replace(text, "'", "'\\''", -1) + "'"
+}
@@ -0,0 +1,321 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+)
+
+const (
+	// logFormat is the format of each commit output by git log with -z so that
+	// every field is separated by a NUL
+	logFormat       = "--format=%H%x00%P%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B"
+	logFormatFields = 9
+)
+
+type execBackend struct {
+	options Options
+}
+
+// NewExecBackend returns a backend which runs the git binary
+func NewExecBackend(options Options) Backend {
+	return &execBackend{
+		options: options,
+	}
+}
+
+func (b *execBackend) Name() string {
+	return Exec
+}
+
+// Clone creates a bare clone of the git repository in the directory
+func (b *execBackend) Clone(ctx context.Context, dir string, source *Source) error {
+	gc, err := newGitContext(source)
+	defer gc.cleanup()
+	if err != nil {
+		return err
+	}
+	parentDir := filepath.Dir(dir)
+	err = os.MkdirAll(parentDir, 0700)
+	if err != nil {
+		return fmt.Errorf("Unable to create directory %s due to: %v", parentDir, err)
+	}
+	args := append([]string{"clone", "--bare"}, b.cloneArgs()...)
+	args = append(args, source.URI, filepath.Base(dir))
+	err = runGit(ctx, gc, parentDir, args...)
+	if err != nil {
+		return err
+	}
+	// a bare clone has no fetch refspec so lets fetch the branches into the local branches
+	err = runGit(ctx, nil, dir, "config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*")
+	if err != nil {
+		return err
+	}
+	return checkExecRef(ctx, dir, source)
+}
+
+// Fetch fetches the latest branches and tags, force updating them so that
+// upstream history rewrites are followed rather than merged
+func (b *execBackend) Fetch(ctx context.Context, dir string, source *Source) (bool, error) {
+	gc, err := newGitContext(source)
+	defer gc.cleanup()
+	if err != nil {
+		return false, err
+	}
+	before, err := gitOutput(ctx, dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return false, fmt.Errorf("Failed to list the refs of %s due to %v", dir, err)
+	}
+	// the depth only applies to the clone so that later fetches keep the history
+	// from the shallow boundary rather than moving it and losing the published commits
+	err = runGit(ctx, gc, dir, "fetch", "--prune", "--force", "--tags", "origin")
+	if err != nil {
+		return false, err
+	}
+	after, err := gitOutput(ctx, dir, "for-each-ref", "--format=%(objectname) %(refname)")
+	changed := err != nil || after != before
+	return changed, checkExecRef(ctx, dir, source)
+}
+
+// checkExecRef checks the ref of the git source can be resolved
+func checkExecRef(ctx context.Context, dir string, source *Source) error {
+	repo := &execRepository{ctx: ctx, dir: dir}
+	commit, err := repo.ResolveRef(source.Ref)
+	if err != nil {
+		return &RefNotFoundError{Ref: source.Ref, URI: source.URI}
+	}
+	util.Infof("Ref %s of %s is at commit %s\n", source.Ref, source.URI, commit.Hash)
+	return nil
+}
+
+// cloneArgs returns the arguments for a shallow or partial clone
+func (b *execBackend) cloneArgs() []string {
+	answer := []string{}
+	if b.options.Depth > 0 {
+		answer = append(answer, "--depth="+strconv.Itoa(b.options.Depth), "--no-single-branch")
+	}
+	if b.options.Blobless {
+		answer = append(answer, "--filter=blob:none")
+	}
+	return answer
+}
+
+// Validate returns an error if the clone is not of the same remote URI as the git source
+// or the ref of the source is not in the clone
+func (b *execBackend) Validate(ctx context.Context, dir string, source *Source) error {
+	uri, err := gitOutput(ctx, dir, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return fmt.Errorf("Failed to find the remote of the clone %s due to %v", dir, err)
+	}
+	if uri != source.URI {
+		return fmt.Errorf("The clone %s is of %s rather than %s", dir, uri, source.URI)
+	}
+	repo := &execRepository{ctx: ctx, dir: dir}
+	if _, err := repo.ResolveRef(source.Ref); err != nil {
+		return &RefNotFoundError{Ref: source.Ref, URI: source.URI}
+	}
+	return nil
+}
+
+func (b *execBackend) Open(ctx context.Context, dir string) (Repository, error) {
+	_, err := gitOutput(ctx, dir, "rev-parse", "--git-dir")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the git repository %s due to %v", dir, err)
+	}
+	return &execRepository{ctx: ctx, dir: dir}, nil
+}
+
+// hasRevision returns true if the revision resolves to a commit
+func hasRevision(ctx context.Context, dir string, rev string) bool {
+	_, err := gitOutput(ctx, dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	return err == nil
+}
+
+// execRepository reads the history of a clone using the git binary
+type execRepository struct {
+	ctx context.Context
+	dir string
+}
+
+func (r *execRepository) ResolveRef(ref string) (*Commit, error) {
+	for _, name := range refCandidates(ref) {
+		if hasRevision(r.ctx, r.dir, name) {
+			return r.commit(name)
+		}
+	}
+	return nil, fmt.Errorf("Could not resolve the git ref %s", ref)
+}
+
+func (r *execRepository) RevList(tip string, exclude []string, options RevListOptions) ([]*Commit, error) {
+	args := []string{"log", "-z", "--topo-order", "--reverse", logFormat}
+	if options.Limit > 0 {
+		args = append(args, "--max-count="+strconv.Itoa(options.Limit))
+	}
+	if !options.Since.IsZero() {
+		args = append(args, "--since="+options.Since.Format(time.RFC3339))
+	}
+	args = append(args, tip)
+	shallow, err := shallowCommits(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range append(exclude, shallow...) {
+		if r.HasCommit(hash) {
+			args = append(args, "^"+hash)
+		}
+	}
+	args = append(args, "--")
+	out, err := gitOutput(r.ctx, r.dir, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the commits of %s due to %v", tip, err)
+	}
+	return parseLog(out)
+}
+
+func (r *execRepository) HasCommit(hash string) bool {
+	_, err := gitOutput(r.ctx, r.dir, "cat-file", "-e", hash+"^{commit}")
+	return err == nil
+}
+
+func (r *execRepository) IsAncestor(ancestor string, tip string) bool {
+	if !r.HasCommit(ancestor) {
+		return false
+	}
+	_, err := gitOutput(r.ctx, r.dir, "merge-base", "--is-ancestor", ancestor, tip)
+	return err == nil
+}
+
+func (r *execRepository) IsShallow() bool {
+	shallow, err := shallowCommits(r.dir)
+	return err == nil && len(shallow) > 0
+}
+
+func (r *execRepository) Diff(commit *Commit) ([]string, error) {
+	var out string
+	var err error
+	if len(commit.ParentHashes) > 0 {
+		out, err = gitOutput(r.ctx, r.dir, "diff", "--name-only", "--no-renames", commit.ParentHashes[0], commit.Hash, "--")
+	} else {
+		out, err = gitOutput(r.ctx, r.dir, "diff-tree", "-r", "--root", "--name-only", "--no-commit-id", commit.Hash, "--")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to diff commit %s due to %v", commit.Hash, err)
+	}
+	answer := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) > 0 {
+			answer = append(answer, line)
+		}
+	}
+	return answer, nil
+}
+
+// commit returns the commit for the revision
+func (r *execRepository) commit(rev string) (*Commit, error) {
+	out, err := gitOutput(r.ctx, r.dir, "log", "-z", "--no-walk", logFormat, rev+"^{commit}", "--")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find commit %s due to %v", rev, err)
+	}
+	commits, err := parseLog(out)
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) != 1 {
+		return nil, fmt.Errorf("Failed to find commit %s", rev)
+	}
+	return commits[0], nil
+}
+
+// parseLog parses the output of git log using logFormat
+func parseLog(out string) ([]*Commit, error) {
+	answer := []*Commit{}
+	if len(out) == 0 {
+		return answer, nil
+	}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	if len(fields)%logFormatFields != 0 {
+		return nil, fmt.Errorf("Failed to parse the output of git log with %d fields", len(fields))
+	}
+	for i := 0; i < len(fields); i += logFormatFields {
+		f := fields[i : i+logFormatFields]
+		commit := &Commit{
+			Hash:         f[0],
+			ParentHashes: strings.Fields(f[1]),
+			Author:       Signature{Name: f[2], Email: f[3], When: parseTime(f[4])},
+			Committer:    Signature{Name: f[5], Email: f[6], When: parseTime(f[7])},
+			Message:      f[8],
+		}
+		answer = append(answer, commit)
+	}
+	return answer, nil
+}
+
+func parseTime(text string) time.Time {
+	answer, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return time.Time{}
+	}
+	return answer
+}
+
+// runGit runs the git command with the given arguments in the directory using the
+// configuration and environment of the git context if there is one
+func runGit(ctx context.Context, gc *gitContext, dir string, args ...string) error {
+	e := exec.Command(gitBinary(), gc.args(args)...)
+	e.Dir = dir
+	e.Env = gc.environ()
+	e.Stdout = os.Stdout
+	e.Stderr = os.Stderr
+	err := runCommand(ctx, e, "git "+args[0])
+	if err != nil {
+		util.Errorf("Unable to run git %s: %v\n", args[0], err)
+		return err
+	}
+	return nil
+}
+
+// gitOutput runs the git command with the given arguments in the directory returning its output
+// with any trailing new line removed
+func gitOutput(ctx context.Context, dir string, args ...string) (string, error) {
+	var out bytes.Buffer
+	e := exec.Command(gitBinary(), args...)
+	e.Dir = dir
+	e.Stdout = &out
+	err := runCommand(ctx, e, "git "+args[0])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out.String(), "\n"), nil
+}
+
+// gitBinary returns the location of git on the PATH
+func gitBinary() string {
+	path, err := exec.LookPath("git")
+	if err != nil {
+		return "git"
+	}
+	return path
+}
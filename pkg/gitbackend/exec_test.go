@@ -0,0 +1,291 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRepo is a git repository created with the git binary whose commits are
+// one minute apart so that the history is the same every time
+type testRepo struct {
+	t    *testing.T
+	root string
+	dir  string
+	when time.Time
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	root, err := ioutil.TempDir("", "gitbackend-")
+	if err != nil {
+		t.Fatalf("Failed to create a temporary directory due to %v", err)
+	}
+	r := &testRepo{
+		t:    t,
+		root: root,
+		dir:  filepath.Join(root, "work"),
+		when: time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC),
+	}
+	err = os.MkdirAll(r.dir, 0700)
+	if err != nil {
+		t.Fatalf("Failed to create %s due to %v", r.dir, err)
+	}
+	r.git("init", "-q")
+	r.git("symbolic-ref", "HEAD", "refs/heads/master")
+	return r
+}
+
+func (r *testRepo) remove() {
+	os.RemoveAll(r.root)
+}
+
+// git runs git in the work tree returning its output
+func (r *testRepo) git(args ...string) string {
+	date := r.when.Format(time.RFC3339)
+	e := exec.Command("git", args...)
+	e.Dir = r.dir
+	e.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Jane", "GIT_AUTHOR_EMAIL=jane@example.com", "GIT_AUTHOR_DATE="+date,
+		"GIT_COMMITTER_NAME=John", "GIT_COMMITTER_EMAIL=john@example.com", "GIT_COMMITTER_DATE="+date,
+	)
+	out, err := e.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("Failed to run git %s due to %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit changes the file and commits it returning the hash of the commit
+func (r *testRepo) commit(file string) string {
+	r.when = r.when.Add(time.Minute)
+	path := filepath.Join(r.dir, file)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(r.when.String()), 0600)
+	}
+	if err != nil {
+		r.t.Fatalf("Failed to write %s due to %v", path, err)
+	}
+	r.git("add", file)
+	r.git("commit", "-q", "-m", "Change "+file)
+	return r.git("rev-parse", "HEAD")
+}
+
+// merge merges the branch into the current branch returning the hash of the merge commit
+func (r *testRepo) merge(branch string) string {
+	r.when = r.when.Add(time.Minute)
+	r.git("merge", "-q", "--no-ff", "-m", "Merge "+branch, branch)
+	return r.git("rev-parse", "HEAD")
+}
+
+// clone creates a bare clone of the repository with the given depth, when greater than zero,
+// like the backends do
+func (r *testRepo) clone(name string, depth int) string {
+	dir := filepath.Join(r.root, name)
+	args := []string{"clone", "-q", "--bare"}
+	if depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", depth))
+	}
+	r.git(append(args, "file://"+r.dir, dir)...)
+	return dir
+}
+
+// testHistory is the history of the test repository
+//
+//	a - b - c ----- m - e   master
+//	      \       /
+//	        d ---           feature
+type testHistory struct {
+	a, b, c, d, m, e string
+}
+
+func newTestHistory(r *testRepo) testHistory {
+	h := testHistory{}
+	h.a = r.commit("README.md")
+	h.b = r.commit("src/main.go")
+	r.git("checkout", "-q", "-b", "feature")
+	r.git("checkout", "-q", "master")
+	h.c = r.commit("README.md")
+	r.git("checkout", "-q", "feature")
+	h.d = r.commit("docs/index.md")
+	r.git("checkout", "-q", "master")
+	h.m = r.merge("feature")
+	h.e = r.commit("src/main.go")
+	return h
+}
+
+func commitHashes(commits []*Commit) []string {
+	answer := []string{}
+	for _, commit := range commits {
+		answer = append(answer, commit.Hash)
+	}
+	return answer
+}
+
+func TestParseLog(t *testing.T) {
+	when := time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		out      string
+		expected []*Commit
+		err      bool
+	}{
+		{
+			name:     "empty",
+			out:      "",
+			expected: []*Commit{},
+		},
+		{
+			name: "root and merge commits",
+			out: "a\x00\x00Jane\x00jane@example.com\x002017-01-31T12:00:00Z\x00John\x00john@example.com\x002017-01-31T12:00:00Z\x00First line\n\nBody\n\x00" +
+				"m\x00a b\x00Jane\x00jane@example.com\x002017-01-31T12:00:00Z\x00John\x00john@example.com\x00invalid\x00Merge\x00",
+			expected: []*Commit{
+				{
+					Hash:         "a",
+					ParentHashes: []string{},
+					Author:       Signature{Name: "Jane", Email: "jane@example.com", When: when},
+					Committer:    Signature{Name: "John", Email: "john@example.com", When: when},
+					Message:      "First line\n\nBody\n",
+				},
+				{
+					Hash:         "m",
+					ParentHashes: []string{"a", "b"},
+					Author:       Signature{Name: "Jane", Email: "jane@example.com", When: when},
+					Committer:    Signature{Name: "John", Email: "john@example.com"},
+					Message:      "Merge",
+				},
+			},
+		},
+		{
+			name: "missing fields",
+			out:  "a\x00\x00Jane\x00",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		actual, err := parseLog(test.out)
+		if test.err {
+			assert.Error(t, err, test.name)
+			continue
+		}
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, test.expected, actual, test.name)
+		}
+	}
+}
+
+func TestExecRevList(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	h := newTestHistory(r)
+	repo, err := NewExecBackend(Options{}).Open(context.Background(), r.clone("mirror", 0))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name     string
+		tip      string
+		exclude  []string
+		options  RevListOptions
+		expected []string
+	}{
+		{name: "all", tip: h.e, expected: []string{h.a, h.b, h.c, h.d, h.m, h.e}},
+		{name: "exclude", tip: h.e, exclude: []string{h.c}, expected: []string{h.d, h.m, h.e}},
+		{name: "exclude many", tip: h.e, exclude: []string{h.c, h.d}, expected: []string{h.m, h.e}},
+		{name: "exclude missing", tip: h.c, exclude: []string{"0123456789012345678901234567890123456789"}, expected: []string{h.a, h.b, h.c}},
+		{name: "limit", tip: h.e, options: RevListOptions{Limit: 2}, expected: []string{h.m, h.e}},
+		{name: "since", tip: h.c, options: RevListOptions{Since: r.when.Add(-3 * time.Minute)}, expected: []string{h.c}},
+	}
+	for _, test := range tests {
+		commits, err := repo.RevList(test.tip, test.exclude, test.options)
+		if assert.NoError(t, err, test.name) {
+			assert.Equal(t, test.expected, commitHashes(commits), test.name)
+		}
+	}
+
+	assert.True(t, repo.IsAncestor(h.b, h.e))
+	assert.True(t, repo.IsAncestor(h.d, h.e))
+	assert.False(t, repo.IsAncestor(h.d, h.c))
+	assert.False(t, repo.IsShallow())
+}
+
+func TestExecRevListShallow(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	h := newTestHistory(r)
+	repo, err := NewExecBackend(Options{}).Open(context.Background(), r.clone("shallow", 2))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, repo.IsShallow())
+
+	// the merge is the boundary of the clone so its excluded as its parents are missing
+	commits, err := repo.RevList(h.e, nil, RevListOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{h.e}, commitHashes(commits))
+	}
+	assert.False(t, repo.HasCommit(h.c))
+	assert.True(t, repo.IsAncestor(h.m, h.e))
+}
+
+func TestExecCloneAndFetch(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	h := newTestHistory(r)
+	ctx := context.Background()
+	backend := NewExecBackend(Options{})
+	source := &Source{URI: "file://" + r.dir, Ref: "feature"}
+	dir := filepath.Join(r.root, "mirror.git")
+	if !assert.NoError(t, backend.Clone(ctx, dir, source)) {
+		return
+	}
+	assert.NoError(t, backend.Validate(ctx, dir, source))
+	assert.NoError(t, backend.Validate(ctx, dir, &Source{URI: source.URI, Ref: h.c}))
+	err := backend.Validate(ctx, dir, &Source{URI: "file:///tmp/other", Ref: "feature"})
+	assert.Error(t, err)
+	assert.False(t, IsRefNotFound(err), "a clone of another repository is invalid")
+	err = backend.Validate(ctx, dir, &Source{URI: source.URI, Ref: "release"})
+	assert.True(t, IsRefNotFound(err), "the release branch is not in the clone: %v", err)
+
+	// the branches deleted upstream are pruned
+	r.git("branch", "release", "feature")
+	r.git("branch", "-D", "feature")
+	release := &Source{URI: source.URI, Ref: "release"}
+	changed, err := backend.Fetch(ctx, dir, release)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, backend.Validate(ctx, dir, release))
+	changed, err = backend.Fetch(ctx, dir, source)
+	assert.False(t, changed)
+	assert.True(t, IsRefNotFound(err), "the feature branch should be pruned: %v", err)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Could not find the ref feature in "+source.URI, err.Error())
+	}
+
+	err = backend.Clone(ctx, filepath.Join(r.root, "other.git"), source)
+	assert.True(t, IsRefNotFound(err), "the feature branch is not upstream: %v", err)
+}
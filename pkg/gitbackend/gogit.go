@@ -0,0 +1,430 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+	"github.com/src-d/go-git"
+	"srcd.works/go-git.v4/config"
+	"srcd.works/go-git.v4/plumbing"
+	"srcd.works/go-git.v4/plumbing/object"
+	"srcd.works/go-git.v4/plumbing/transport"
+)
+
+// fetchRefSpecs force updates the branches and tags of the bare clone so that
+// upstream history rewrites are followed
+var fetchRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+type goGitBackend struct {
+	options Options
+	dirs    *dirLocks
+}
+
+// NewGoGitBackend returns a backend which uses the pure go implementation of git
+// so that no git binary is required
+func NewGoGitBackend(options Options) Backend {
+	if options.Blobless {
+		util.Warnf("The %s git backend does not support blobless clones so full clones will be used\n", GoGit)
+	}
+	return &goGitBackend{
+		options: options,
+		dirs:    newDirLocks(),
+	}
+}
+
+func (b *goGitBackend) Name() string {
+	return GoGit
+}
+
+// Clone creates a bare clone of the git repository.
+//
+// The clone is made in a temporary directory next to the clone directory which is only
+// renamed into place once complete, so a clone which times out and is left running in the
+// background never writes into a directory which is removed or cloned into again
+func (b *goGitBackend) Clone(ctx context.Context, dir string, source *Source) error {
+	auth, err := source.Credentials.authMethod(source.URI)
+	if err != nil {
+		return fmt.Errorf("Failed to create git authentication for %s due to %v", source.URI, err)
+	}
+	registerGoGitProxy(source.URI, source.Proxy)
+	release, err := b.dirs.acquire(ctx, dir, "git clone")
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".clone-")
+	if err != nil {
+		release()
+		return fmt.Errorf("Failed to create a temporary directory to clone %s due to %v", source.URI, err)
+	}
+	options := git.CloneOptions{
+		URL:      source.URI,
+		Auth:     auth,
+		Depth:    b.options.Depth,
+		Progress: os.Stdout,
+	}
+	err = runWithContext(ctx, "git clone", func() error {
+		defer release()
+		err := b.cloneInto(ctx, tmpDir, dir, &options)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	return checkRef(repo, source)
+}
+
+// cloneInto clones and fetches into the temporary directory then renames it to the clone
+// directory unless the context was done in the meantime
+func (b *goGitBackend) cloneInto(ctx context.Context, tmpDir string, dir string, options *git.CloneOptions) error {
+	repo, err := git.PlainClone(tmpDir, true, options)
+	if err != nil {
+		return err
+	}
+	_, err = b.fetchRefs(repo, options.Auth)
+	if err != nil {
+		return err
+	}
+	if err := contextError(ctx, "git clone"); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+func (b *goGitBackend) Fetch(ctx context.Context, dir string, source *Source) (bool, error) {
+	auth, err := source.Credentials.authMethod(source.URI)
+	if err != nil {
+		return false, fmt.Errorf("Failed to create git authentication for %s due to %v", source.URI, err)
+	}
+	registerGoGitProxy(source.URI, source.Proxy)
+	release, err := b.dirs.acquire(ctx, dir, "git fetch")
+	if err != nil {
+		return false, err
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		release()
+		return false, err
+	}
+	changed := false
+	err = runWithContext(ctx, "git fetch", func() error {
+		defer release()
+		fetched, err := b.fetchRefs(repo, auth)
+		if err != nil {
+			return err
+		}
+		pruned, err := pruneRefs(repo, source.URI, auth)
+		changed = fetched || pruned
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return changed, checkRef(repo, source)
+}
+
+// fetchRefs fetches the branches and tags returning true if any of them changed.
+// The depth only applies to the clone
+func (b *goGitBackend) fetchRefs(repo *git.Repository, auth transport.AuthMethod) (bool, error) {
+	err := repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   fetchRefSpecs,
+		Auth:       auth,
+		Progress:   os.Stdout,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// pruneRefs removes the branches and tags which no longer exist upstream like
+// `git fetch --prune`, as fetching with go-git only adds and updates refs, returning
+// true if any were removed
+func pruneRefs(repo *git.Repository, uri string, auth transport.AuthMethod) (bool, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return false, err
+	}
+	remoteRefs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return false, fmt.Errorf("Failed to list the refs of %s due to %v", uri, err)
+	}
+	upstream := map[plumbing.ReferenceName]bool{}
+	for _, ref := range remoteRefs {
+		upstream[ref.Name()] = true
+	}
+	refs, err := repo.References()
+	if err != nil {
+		return false, err
+	}
+	stale := []plumbing.ReferenceName{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if (name.IsBranch() || name.IsTag()) && !upstream[name] {
+			stale = append(stale, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, name := range stale {
+		util.Infof("Pruning %s of %s as it no longer exists upstream\n", name, uri)
+		err = repo.Storer.RemoveReference(name)
+		if err != nil {
+			return false, fmt.Errorf("Failed to prune %s of %s due to %v", name, uri, err)
+		}
+	}
+	return len(stale) > 0, nil
+}
+
+// checkRef checks the ref of the git source can be resolved
+func checkRef(repo *git.Repository, source *Source) error {
+	commit, err := resolveRef(repo, source.Ref)
+	if err != nil {
+		return &RefNotFoundError{Ref: source.Ref, URI: source.URI, Err: err}
+	}
+	util.Infof("Ref %s of %s is at commit %s\n", source.Ref, source.URI, commit.Hash)
+	return nil
+}
+
+// dirLocks serialises the go-git operations on each directory. As go-git cannot be
+// interrupted an operation which timed out holds the lock until it really finishes
+// so the next operation on the directory waits for it rather than racing with it
+type dirLocks struct {
+	lock sync.Mutex
+	dirs map[string]chan struct{}
+}
+
+func newDirLocks() *dirLocks {
+	return &dirLocks{
+		dirs: map[string]chan struct{}{},
+	}
+}
+
+// acquire waits for the lock of the directory until the context is done and returns
+// the function which releases it
+func (l *dirLocks) acquire(ctx context.Context, dir string, operation string) (func(), error) {
+	l.lock.Lock()
+	ch := l.dirs[dir]
+	if ch == nil {
+		ch = make(chan struct{}, 1)
+		l.dirs[dir] = ch
+	}
+	l.lock.Unlock()
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, contextError(ctx, operation)
+	}
+}
+
+// Validate returns an error if the clone is not of the same remote URI as the git source
+// or the ref of the source is not in the clone
+func (b *goGitBackend) Validate(ctx context.Context, dir string, source *Source) error {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to open the clone %s due to %v", dir, err)
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil || remote == nil {
+		return fmt.Errorf("Failed to find the remote of the clone %s due to %v", dir, err)
+	}
+	if uri := remote.Config().URL; uri != source.URI {
+		return fmt.Errorf("The clone %s is of %s rather than %s", dir, uri, source.URI)
+	}
+	if _, err := resolveRef(repo, source.Ref); err != nil {
+		return &RefNotFoundError{Ref: source.Ref, URI: source.URI, Err: err}
+	}
+	return nil
+}
+
+func (b *goGitBackend) Open(ctx context.Context, dir string) (Repository, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open the git repository %s due to %v", dir, err)
+	}
+	return &goGitRepository{repo: repo, dir: dir}, nil
+}
+
+// goGitRepository reads the history of a clone using go-git
+type goGitRepository struct {
+	repo *git.Repository
+	dir  string
+}
+
+func (r *goGitRepository) ResolveRef(ref string) (*Commit, error) {
+	commit, err := resolveRef(r.repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	return newCommit(commit), nil
+}
+
+func (r *goGitRepository) RevList(tip string, exclude []string, options RevListOptions) ([]*Commit, error) {
+	tipCommit, err := r.repo.Commit(plumbing.NewHash(tip))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find commit %s due to: %v", tip, err)
+	}
+	shallow, err := r.shallow()
+	if err != nil {
+		return nil, err
+	}
+	hashes := []plumbing.Hash{}
+	for _, hash := range exclude {
+		hashes = append(hashes, plumbing.NewHash(hash))
+	}
+	for hash := range shallow {
+		hashes = append(hashes, hash)
+	}
+	commits, err := revList(r.repo, tipCommit, hashes, shallow, options)
+	if err != nil {
+		return nil, err
+	}
+	answer := []*Commit{}
+	for _, commit := range commits {
+		answer = append(answer, newCommit(commit))
+	}
+	return answer, nil
+}
+
+func (r *goGitRepository) HasCommit(hash string) bool {
+	_, err := r.repo.Commit(plumbing.NewHash(hash))
+	return err == nil
+}
+
+func (r *goGitRepository) IsAncestor(ancestor string, tip string) bool {
+	commit, err := r.repo.Commit(plumbing.NewHash(ancestor))
+	if err != nil {
+		return false
+	}
+	shallow, err := r.shallow()
+	if err != nil {
+		return false
+	}
+	commits, err := revList(r.repo, commit, []plumbing.Hash{plumbing.NewHash(tip)}, shallow, RevListOptions{})
+	return err == nil && len(commits) == 0
+}
+
+func (r *goGitRepository) IsShallow() bool {
+	shallow, err := r.shallow()
+	return err == nil && len(shallow) > 0
+}
+
+// shallow returns the boundary commits of a shallow clone
+func (r *goGitRepository) shallow() (map[plumbing.Hash]bool, error) {
+	hashes, err := shallowCommits(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	answer := map[plumbing.Hash]bool{}
+	for _, hash := range hashes {
+		answer[plumbing.NewHash(hash)] = true
+	}
+	return answer, nil
+}
+
+func (r *goGitRepository) Diff(commit *Commit) ([]string, error) {
+	c, err := r.repo.Commit(plumbing.NewHash(commit.Hash))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find commit %s due to: %v", commit.Hash, err)
+	}
+	files, err := treeFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	parentFiles := map[string]plumbing.Hash{}
+	if len(c.ParentHashes) > 0 {
+		parent, err := r.repo.Commit(c.ParentHashes[0])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find parent commit %s of %s due to: %v", c.ParentHashes[0], commit.Hash, err)
+		}
+		parentFiles, err = treeFiles(parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	answer := []string{}
+	for name, hash := range files {
+		if parentHash, ok := parentFiles[name]; !ok || parentHash != hash {
+			answer = append(answer, name)
+		}
+	}
+	for name := range parentFiles {
+		if _, ok := files[name]; !ok {
+			answer = append(answer, name)
+		}
+	}
+	sort.Strings(answer)
+	return answer, nil
+}
+
+// treeFiles returns the hash of every file in the tree of the commit by path
+func treeFiles(commit *object.Commit) (map[string]plumbing.Hash, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find the tree of commit %s due to: %v", commit.Hash, err)
+	}
+	answer := map[string]plumbing.Hash{}
+	iter := tree.Files()
+	defer iter.Close()
+	err = iter.ForEach(func(f *object.File) error {
+		answer[f.Name] = f.Hash
+		return nil
+	})
+	return answer, err
+}
+
+func newCommit(commit *object.Commit) *Commit {
+	parents := []string{}
+	for _, hash := range commit.ParentHashes {
+		parents = append(parents, hash.String())
+	}
+	return &Commit{
+		Hash:         commit.Hash.String(),
+		Message:      commit.Message,
+		Author:       newSignature(&commit.Author),
+		Committer:    newSignature(&commit.Committer),
+		ParentHashes: parents,
+	}
+}
+
+func newSignature(sig *object.Signature) Signature {
+	return Signature{
+		Name:  sig.Name,
+		Email: sig.Email,
+		When:  sig.When,
+	}
+}
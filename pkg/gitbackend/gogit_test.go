@@ -0,0 +1,173 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"srcd.works/go-git.v4/plumbing"
+	"srcd.works/go-git.v4/plumbing/object"
+)
+
+// TestGoGitRevListMatchesExec checks go-git lists the same history in the same order as git
+func TestGoGitRevListMatchesExec(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	h := newTestHistory(r)
+
+	for _, depth := range []int{0, 2} {
+		dir := r.clone(fmt.Sprintf("mirror-%d", depth), depth)
+		execRepo, err := NewExecBackend(Options{}).Open(context.Background(), dir)
+		if !assert.NoError(t, err) {
+			return
+		}
+		goGitRepo, err := NewGoGitBackend(Options{}).Open(context.Background(), dir)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, execRepo.IsShallow(), goGitRepo.IsShallow(), "depth %d", depth)
+
+		tests := []struct {
+			name    string
+			tip     string
+			exclude []string
+			options RevListOptions
+		}{
+			{name: "all", tip: h.e},
+			{name: "exclude", tip: h.e, exclude: []string{h.c}},
+			{name: "exclude many", tip: h.e, exclude: []string{h.c, h.d}},
+			{name: "exclude missing", tip: h.e, exclude: []string{"0123456789012345678901234567890123456789"}},
+			{name: "limit", tip: h.e, options: RevListOptions{Limit: 2}},
+			{name: "limit and exclude", tip: h.e, exclude: []string{h.d}, options: RevListOptions{Limit: 2}},
+			{name: "since", tip: h.e, options: RevListOptions{Since: r.when.Add(-2 * time.Minute)}},
+		}
+		for _, test := range tests {
+			expected, err := execRepo.RevList(test.tip, test.exclude, test.options)
+			if !assert.NoError(t, err, "%s with depth %d", test.name, depth) {
+				continue
+			}
+			actual, err := goGitRepo.RevList(test.tip, test.exclude, test.options)
+			if assert.NoError(t, err, "%s with depth %d", test.name, depth) {
+				assert.Equal(t, commitHashes(expected), commitHashes(actual), "%s with depth %d", test.name, depth)
+			}
+		}
+		for _, ancestor := range []string{h.a, h.c, h.d, h.m} {
+			assert.Equal(t, execRepo.IsAncestor(ancestor, h.e), goGitRepo.IsAncestor(ancestor, h.e), "IsAncestor(%s) with depth %d", ancestor, depth)
+		}
+	}
+}
+
+// TestGoGitRevListLimitWithClockSkew checks the limit only counts the commits which are not
+// excluded when a commit from the future is walked before it is found to be excluded
+func TestGoGitRevListLimitWithClockSkew(t *testing.T) {
+	r := newTestRepo(t)
+	defer r.remove()
+	r.commit("README.md")
+	when := r.when
+	r.when = r.when.Add(time.Hour)
+	skewed := r.commit("src/main.go")
+	r.when = when
+	r.git("checkout", "-q", "-b", "feature")
+	r.git("checkout", "-q", "master")
+	excluded := r.commit("README.md")
+	r.git("checkout", "-q", "feature")
+	r.commit("docs/index.md")
+	tip := r.commit("docs/index.md")
+
+	dir := r.clone("mirror", 0)
+	execRepo, err := NewExecBackend(Options{}).Open(context.Background(), dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	goGitRepo, err := NewGoGitBackend(Options{}).Open(context.Background(), dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, limit := range []int{1, 2, 3} {
+		options := RevListOptions{Limit: limit}
+		expected, err := execRepo.RevList(tip, []string{excluded}, options)
+		if !assert.NoError(t, err, "limit %d", limit) {
+			continue
+		}
+		actual, err := goGitRepo.RevList(tip, []string{excluded}, options)
+		if assert.NoError(t, err, "limit %d", limit) {
+			assert.Equal(t, commitHashes(expected), commitHashes(actual), "limit %d", limit)
+			assert.NotContains(t, commitHashes(actual), skewed, "limit %d", limit)
+		}
+	}
+}
+
+func TestTopoSort(t *testing.T) {
+	when := time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC)
+	commit := func(hash string, minutes int, parents ...string) *object.Commit {
+		c := &object.Commit{
+			Hash:      plumbing.NewHash(hash),
+			Committer: object.Signature{When: when.Add(time.Duration(minutes) * time.Minute)},
+		}
+		for _, parent := range parents {
+			c.ParentHashes = append(c.ParentHashes, plumbing.NewHash(parent))
+		}
+		return c
+	}
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccccccccccc"
+	d := "dddddddddddddddddddddddddddddddddddddddd"
+	m := "eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"
+
+	tests := []struct {
+		name     string
+		commits  []*object.Commit
+		expected []string
+	}{
+		{
+			name:     "oldest first",
+			commits:  []*object.Commit{commit(c, 3, b), commit(b, 2, a), commit(a, 1)},
+			expected: []string{a, b, c},
+		},
+		{
+			name:     "parents before children despite clock skew",
+			commits:  []*object.Commit{commit(a, 5), commit(b, 1, a), commit(c, 2, b)},
+			expected: []string{a, b, c},
+		},
+		{
+			name:     "branches by committer time",
+			commits:  []*object.Commit{commit(m, 5, c, d), commit(d, 4, a), commit(c, 3, a), commit(a, 1)},
+			expected: []string{a, c, d, m},
+		},
+		{
+			name:     "parents outside the commits",
+			commits:  []*object.Commit{commit(d, 4, b), commit(c, 3, a)},
+			expected: []string{c, d},
+		},
+		{
+			name:     "same time by hash",
+			commits:  []*object.Commit{commit(b, 1), commit(a, 1)},
+			expected: []string{a, b},
+		},
+	}
+	for _, test := range tests {
+		actual := []string{}
+		for _, commit := range topoSort(test.commits) {
+			actual = append(actual, commit.Hash.String())
+		}
+		assert.Equal(t, test.expected, actual, test.name)
+	}
+}
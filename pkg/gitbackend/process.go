@@ -0,0 +1,82 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// runCommand runs the command until it completes or the context is done in which case
+// the command and any processes it started, like ssh or the git remote helpers,
+// are killed and an error saying the operation timed out or was cancelled is returned
+func runCommand(ctx context.Context, e *exec.Cmd, operation string) error {
+	if err := contextError(ctx, operation); err != nil {
+		return err
+	}
+	setProcessGroup(e)
+	err := e.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		killProcessGroup(e)
+		<-done
+		return contextError(ctx, operation)
+	}
+}
+
+// runWithContext runs the function until it completes or the context is done.
+//
+// This is used for go-git which cannot be interrupted; if the context is done first
+// the function is left running in the background and its result is ignored so it must
+// clean up after itself and not touch anything the caller may reuse once it returns
+func runWithContext(ctx context.Context, operation string, fn func() error) error {
+	if err := contextError(ctx, operation); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return contextError(ctx, operation)
+	}
+}
+
+// contextError returns an error saying the operation timed out or was cancelled
+// if the context is done otherwise nil
+func contextError(ctx context.Context, operation string) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%s timed out", operation)
+	default:
+		return fmt.Errorf("%s was cancelled", operation)
+	}
+}
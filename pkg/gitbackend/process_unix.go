@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the command in its own process group so that it can be
+// killed along with any processes it starts
+func setProcessGroup(e *exec.Cmd) {
+	e.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group of the command
+func killProcessGroup(e *exec.Cmd) {
+	if e.Process == nil {
+		return
+	}
+	err := syscall.Kill(-e.Process.Pid, syscall.SIGKILL)
+	if err != nil {
+		e.Process.Kill()
+	}
+}
@@ -0,0 +1,31 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on windows
+func setProcessGroup(e *exec.Cmd) {
+}
+
+// killProcessGroup kills the process of the command as windows has no process groups
+func killProcessGroup(e *exec.Cmd) {
+	if e.Process != nil {
+		e.Process.Kill()
+	}
+}
@@ -0,0 +1,173 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	gitclient "srcd.works/go-git.v4/plumbing/transport/client"
+	githttp "srcd.works/go-git.v4/plumbing/transport/http"
+)
+
+// env returns the environment variables to make git use the proxy configuration.
+// Both cases are set as curl only honours the lower case http_proxy
+func (p Proxy) env() []string {
+	answer := []string{}
+	add := func(name string, value string) {
+		if len(value) > 0 {
+			answer = append(answer, strings.ToUpper(name)+"="+value, name+"="+value)
+		}
+	}
+	add("http_proxy", p.HTTPProxy)
+	add("https_proxy", p.HTTPSProxy)
+	add("no_proxy", p.NoProxy)
+	return answer
+}
+
+// IsEmpty returns true if there is no proxy
+func (p Proxy) IsEmpty() bool {
+	return len(p.HTTPProxy) == 0 && len(p.HTTPSProxy) == 0
+}
+
+// URL returns the proxy to use for the request URL or nil if it should not be proxied
+func (p Proxy) URL(u *url.URL) (*url.URL, error) {
+	proxy := ""
+	switch u.Scheme {
+	case "http":
+		proxy = p.HTTPProxy
+	case "https":
+		proxy = p.HTTPSProxy
+	}
+	if len(proxy) == 0 || matchesNoProxy(p.NoProxy, u.Host) {
+		return nil, nil
+	}
+	answer, err := url.Parse(proxy)
+	if err != nil || len(answer.Host) == 0 {
+		// lets allow the proxy to be specified without a scheme like curl does
+		answer, err = url.Parse("http://" + proxy)
+	}
+	return answer, err
+}
+
+// matchesNoProxy returns true if the host matches any of the comma separated
+// host names, domains, IP addresses or CIDRs in noProxy
+func matchesNoProxy(noProxy string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if len(entry) == 0 {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPClient returns a HTTP client which uses the proxy
+// or nil to use the default client if there is no proxy
+func (p Proxy) HTTPClient() *http.Client {
+	if p.IsEmpty() {
+		return nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return p.URL(req.URL)
+			},
+		},
+	}
+}
+
+// gitProxies are the proxy configurations of the git repositories cloned with go-git
+// which has a single HTTP transport for all repositories
+type gitProxies struct {
+	lock    sync.Mutex
+	proxies map[string]Proxy
+}
+
+var goGitProxies = &gitProxies{
+	proxies: map[string]Proxy{},
+}
+
+var installGoGitProxies sync.Once
+
+// registerGoGitProxy registers the proxy configuration for the git repository URI
+// so that the go-git HTTP transport uses the right proxy for each repository
+func registerGoGitProxy(uri string, proxy Proxy) {
+	installGoGitProxies.Do(func() {
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy: goGitProxies.proxy,
+			},
+		}
+		gitclient.InstallProtocol("http", githttp.NewClient(client))
+		gitclient.InstallProtocol("https", githttp.NewClient(client))
+	})
+	if u, err := url.Parse(uri); err == nil {
+		u.User = nil
+		uri = u.String()
+	}
+	uri = strings.TrimSuffix(uri, "/")
+	goGitProxies.lock.Lock()
+	defer goGitProxies.lock.Unlock()
+	if !proxy.IsEmpty() {
+		goGitProxies.proxies[uri] = proxy
+	} else {
+		delete(goGitProxies.proxies, uri)
+	}
+}
+
+// proxy returns the proxy of the repository with the longest URI which prefixes the request URL
+func (p *gitProxies) proxy(req *http.Request) (*url.URL, error) {
+	u := *req.URL
+	u.User = nil
+	requestURL := u.String()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	found := ""
+	for uri := range p.proxies {
+		if len(uri) > len(found) && (requestURL == uri || strings.HasPrefix(requestURL, uri+"/")) {
+			found = uri
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	return p.proxies[found].URL(req.URL)
+}
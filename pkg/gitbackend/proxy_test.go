@@ -0,0 +1,81 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesNoProxy(t *testing.T) {
+	tests := []struct {
+		noProxy  string
+		host     string
+		expected bool
+	}{
+		{"", "github.com", false},
+		{"*", "github.com", true},
+		{"github.com", "github.com", true},
+		{"github.com", "GitHub.com", true},
+		{"github.com", "github.com:443", true},
+		{"github.com", "api.github.com", true},
+		{".github.com", "api.github.com", true},
+		{".github.com", "github.com", true},
+		{"github.com", "notgithub.com", false},
+		{"github.com:8443", "github.com", true},
+		{"localhost, github.com ,", "github.com", true},
+		{"localhost,gitlab.com", "github.com", false},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "10.1.2.3:8080", true},
+		{"10.0.0.0/8", "192.168.0.1", false},
+		{"10.0.0.0/8", "github.com", false},
+		{"192.168.0.1", "192.168.0.1", true},
+		{"::1", "[::1]:8080", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, matchesNoProxy(test.noProxy, test.host), "no_proxy %q with host %q", test.noProxy, test.host)
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	proxy := Proxy{
+		HTTPProxy:  "http://proxy:3128",
+		HTTPSProxy: "secure-proxy:3129",
+		NoProxy:    "internal.example.com",
+	}
+	tests := []struct {
+		uri      string
+		expected string
+	}{
+		{"http://github.com/fabric8io/gitcollector.git", "http://proxy:3128"},
+		{"https://github.com/fabric8io/gitcollector.git", "http://secure-proxy:3129"},
+		{"https://git.internal.example.com/gitcollector.git", ""},
+		{"ssh://git@github.com/fabric8io/gitcollector.git", ""},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.uri)
+		assert.NoError(t, err)
+		answer, err := proxy.URL(u)
+		assert.NoError(t, err, test.uri)
+		if len(test.expected) == 0 {
+			assert.Nil(t, answer, test.uri)
+		} else if assert.NotNil(t, answer, test.uri) {
+			assert.Equal(t, test.expected, answer.String(), test.uri)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package gitbackend
+
+import (
+	"container/heap"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/src-d/go-git"
+	"srcd.works/go-git.v4/plumbing"
+	"srcd.works/go-git.v4/plumbing/object"
+)
+
+var shaRegex = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
+// refCandidates returns the names to try in order when resolving a ref
+// which can be a branch, a tag, a full ref name or a commit SHA
+func refCandidates(ref string) []string {
+	if shaRegex.MatchString(ref) {
+		return []string{ref}
+	}
+	if len(ref) == 0 {
+		return []string{"HEAD"}
+	}
+	if strings.HasPrefix(ref, "refs/") {
+		return []string{ref}
+	}
+	answer := []string{}
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/origin/", "refs/tags/"} {
+		answer = append(answer, prefix+ref)
+	}
+	return answer
+}
+
+// resolveRef returns the commit at the tip of the given ref which can be a branch,
+// a tag or a commit SHA. An empty ref resolves to HEAD
+func resolveRef(repo *git.Repository, ref string) (*object.Commit, error) {
+	if shaRegex.MatchString(ref) {
+		return repo.Commit(plumbing.NewHash(ref))
+	}
+	for _, candidate := range refCandidates(ref) {
+		name := plumbing.ReferenceName(candidate)
+		r, err := repo.Reference(name, true)
+		if err != nil || r == nil {
+			continue
+		}
+		hash := r.Hash()
+		commit, err := repo.Commit(hash)
+		if err == nil {
+			return commit, nil
+		}
+		// lets try peel an annotated tag
+		tag, tagErr := repo.Tag(hash)
+		if tagErr != nil {
+			return nil, fmt.Errorf("Failed to find commit %s for ref %s due to: %v", hash, name, err)
+		}
+		return tag.Commit()
+	}
+	return nil, fmt.Errorf("Could not resolve the git ref %s", ref)
+}
+
+type revListItem struct {
+	commit        *object.Commit
+	uninteresting bool
+}
+
+// revListQueue is a priority queue of commits, newest committer time first
+type revListQueue []*revListItem
+
+func (q revListQueue) Len() int { return len(q) }
+func (q revListQueue) Less(i, j int) bool {
+	return q[i].commit.Committer.When.After(q[j].commit.Committer.When)
+}
+func (q revListQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *revListQueue) Push(x interface{}) { *q = append(*q, x.(*revListItem)) }
+func (q *revListQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// revList returns the commits reachable from tip which are not reachable from any of the
+// excluded commits, like `git rev-list tip ^exclude...`, ordered so that parents come before
+// their children and older commits come first.
+//
+// If the limit of the options is greater than zero only the newest limit commits are returned,
+// which like `git rev-list --max-count` is applied after the excluded history has been walked.
+// Like `git rev-list --since` commits older than since are not returned and their parents
+// are not walked. Excluded commits which are not in the repository are ignored as are the
+// missing parents of the shallow boundary commits
+func revList(repo *git.Repository, tip *object.Commit, exclude []plumbing.Hash, shallow map[plumbing.Hash]bool, options RevListOptions) ([]*object.Commit, error) {
+	limit := options.Limit
+	queue := &revListQueue{}
+	queued := map[plumbing.Hash]bool{}
+	uninteresting := map[plumbing.Hash]bool{}
+	// walked is the interesting commits in the order they were walked, newest first
+	walked := []*object.Commit{}
+	interestingQueued := 0
+	var oldest time.Time
+
+	push := func(commit *object.Commit, isUninteresting bool) {
+		if isUninteresting {
+			if uninteresting[commit.Hash] {
+				return
+			}
+			uninteresting[commit.Hash] = true
+		} else {
+			if queued[commit.Hash] || uninteresting[commit.Hash] {
+				return
+			}
+			queued[commit.Hash] = true
+			interestingQueued++
+		}
+		heap.Push(queue, &revListItem{commit: commit, uninteresting: isUninteresting})
+	}
+
+	push(tip, false)
+	for _, hash := range exclude {
+		commit, err := repo.Commit(hash)
+		if err != nil {
+			continue
+		}
+		push(commit, true)
+	}
+
+	for queue.Len() > 0 {
+		if interestingQueued == 0 {
+			// lets keep walking the excluded history while it overlaps the interesting commits
+			// so that clock skew does not cause us to return commits which are excluded
+			next := (*queue)[0].commit.Committer.When
+			if oldest.IsZero() || next.Before(oldest) {
+				break
+			}
+		}
+		if limit > 0 && len(uninteresting) == 0 && len(walked) >= limit {
+			// without excluded history the newest commits can't be excluded later on
+			break
+		}
+		item := heap.Pop(queue).(*revListItem)
+		commit := item.commit
+		if !item.uninteresting {
+			interestingQueued--
+			if uninteresting[commit.Hash] {
+				continue
+			}
+			if !options.Since.IsZero() && commit.Committer.When.Before(options.Since) {
+				continue
+			}
+			walked = append(walked, commit)
+			if oldest.IsZero() || commit.Committer.When.Before(oldest) {
+				oldest = commit.Committer.When
+			}
+		}
+		if shallow[commit.Hash] {
+			continue
+		}
+		for _, parentHash := range commit.ParentHashes {
+			parent, err := repo.Commit(parentHash)
+			if err != nil {
+				if item.uninteresting {
+					continue
+				}
+				return nil, fmt.Errorf("Failed to find parent commit %s of %s due to: %v", parentHash, commit.Hash, err)
+			}
+			push(parent, item.uninteresting)
+		}
+	}
+
+	// the limit only applies to the commits which turned out not to be excluded
+	commits := []*object.Commit{}
+	for _, commit := range walked {
+		if limit > 0 && len(commits) >= limit {
+			break
+		}
+		if !uninteresting[commit.Hash] {
+			commits = append(commits, commit)
+		}
+	}
+	return topoSort(commits), nil
+}
+
+// topoSort orders the commits so that parents come before their children,
+// otherwise ordering by committer time oldest first
+func topoSort(commits []*object.Commit) []*object.Commit {
+	inSet := map[plumbing.Hash]bool{}
+	for _, commit := range commits {
+		inSet[commit.Hash] = true
+	}
+	children := map[plumbing.Hash][]*object.Commit{}
+	pendingParents := map[plumbing.Hash]int{}
+	ready := []*object.Commit{}
+	for _, commit := range commits {
+		count := 0
+		for _, parentHash := range commit.ParentHashes {
+			if inSet[parentHash] {
+				count++
+				children[parentHash] = append(children[parentHash], commit)
+			}
+		}
+		pendingParents[commit.Hash] = count
+		if count == 0 {
+			ready = append(ready, commit)
+		}
+	}
+	answer := []*object.Commit{}
+	for len(ready) > 0 {
+		sort.Sort(byCommitterTime(ready))
+		commit := ready[0]
+		ready = ready[1:]
+		answer = append(answer, commit)
+		for _, child := range children[commit.Hash] {
+			pendingParents[child.Hash]--
+			if pendingParents[child.Hash] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+	return answer
+}
+
+type byCommitterTime []*object.Commit
+
+func (c byCommitterTime) Len() int      { return len(c) }
+func (c byCommitterTime) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCommitterTime) Less(i, j int) bool {
+	ti := c[i].Committer.When
+	tj := c[j].Committer.When
+	if ti.Equal(tj) {
+		return c[i].Hash.String() < c[j].Hash.String()
+	}
+	return ti.Before(tj)
+}
@@ -0,0 +1,382 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+const (
+	defaultBuildConfigIndex = "gitcollector-buildconfigs"
+	defaultCommitIndex      = "gitcollector-commits"
+	defaultRewriteIndex     = "gitcollector-rewrites"
+	defaultBulkSize         = 500
+
+	elasticsearchDocType = "_doc"
+)
+
+// ElasticsearchOptions are the indices the documents are stored in and how they are published
+type ElasticsearchOptions struct {
+	BuildConfigIndex string `json:"buildConfigIndex,omitempty"`
+	CommitIndex      string `json:"commitIndex,omitempty"`
+	RewriteIndex     string `json:"rewriteIndex,omitempty"`
+	// BulkSize is the maximum number of documents in each _bulk request
+	BulkSize int `json:"bulkSize,omitempty"`
+}
+
+// withDefaults returns a copy of the options with any missing values defaulted
+func (o ElasticsearchOptions) withDefaults() ElasticsearchOptions {
+	if len(o.BuildConfigIndex) == 0 {
+		o.BuildConfigIndex = defaultBuildConfigIndex
+	}
+	if len(o.CommitIndex) == 0 {
+		o.CommitIndex = defaultCommitIndex
+	}
+	if len(o.RewriteIndex) == 0 {
+		o.RewriteIndex = defaultRewriteIndex
+	}
+	if o.BulkSize <= 0 {
+		o.BulkSize = defaultBulkSize
+	}
+	return o
+}
+
+// elasticsearchSink publishes the documents to Elasticsearch. BuildConfigs, commits and history
+// rewrites are stored in separate indices using IDs derived from the namespace and name of the
+// BuildConfig so that publishing the same document again replaces it
+type elasticsearchSink struct {
+	httpSink
+	options ElasticsearchOptions
+
+	// lock guards creating the index templates which is retried until it succeeds
+	lock             sync.Mutex
+	templatesCreated bool
+}
+
+// NewElasticsearchSink creates a Sink with the given name for Elasticsearch at the given URL
+func NewElasticsearchSink(name string, u string, httpOptions HTTPOptions, options ElasticsearchOptions) (Sink, error) {
+	base, err := newHTTPSink(name, u, httpOptions)
+	if err != nil {
+		return nil, err
+	}
+	options = options.withDefaults()
+	indices := []string{options.BuildConfigIndex, options.CommitIndex, options.RewriteIndex}
+	for _, index := range indices {
+		if index != strings.ToLower(index) || strings.ContainsAny(index, "/\\*?\"<>| ,#") {
+			return nil, fmt.Errorf("Invalid Elasticsearch index name %s", index)
+		}
+	}
+	return &elasticsearchSink{
+		httpSink: base,
+		options:  options,
+	}, nil
+}
+
+// Start creates the index templates so that the indices have the right mappings
+func (s *elasticsearchSink) Start() error {
+	return s.createTemplates()
+}
+
+func (s *elasticsearchSink) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
+	data, err := marshalBuildConfig(bc)
+	if err != nil {
+		return err
+	}
+	return s.index(s.options.BuildConfigIndex, buildConfigID(bc.Namespace, bc.Name), data)
+}
+
+// UpsertGitCommits indexes the commits using the _bulk API
+func (s *elasticsearchSink) UpsertGitCommits(dtos []*BuildConfigCommit) error {
+	err := s.createTemplates()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(dtos); start += s.options.BulkSize {
+		end := start + s.options.BulkSize
+		if end > len(dtos) {
+			end = len(dtos)
+		}
+		var body bytes.Buffer
+		for _, dto := range dtos[start:end] {
+			err = writeBulkIndex(&body, s.options.CommitIndex, commitID(dto), dto)
+			if err != nil {
+				return err
+			}
+		}
+		err = s.bulk(body.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *elasticsearchSink) UpsertHistoryRewritten(dto *HistoryRewritten) error {
+	data, err := json.Marshal(dto)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal HistoryRewritten to JSON: %v", err)
+	}
+	id := buildConfigID(dto.Namespace, dto.BuildConfigName) + "/" + dto.NewHash
+	return s.index(s.options.RewriteIndex, id, data)
+}
+
+func (s *elasticsearchSink) DeleteBuildConfig(namespace string, name string) error {
+	return s.delete(s.documentURL(s.options.BuildConfigIndex, buildConfigID(namespace, name)))
+}
+
+// DeleteGitCommits deletes the commits and history rewritten events of the BuildConfig using the _delete_by_query API
+func (s *elasticsearchSink) DeleteGitCommits(namespace string, name string) error {
+	for _, index := range []string{s.options.CommitIndex, s.options.RewriteIndex} {
+		err := s.deleteByBuildConfig(index, namespace, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteByQueryResponse is the part of the response of the _delete_by_query API used to detect failures
+type deleteByQueryResponse struct {
+	Deleted  int `json:"deleted"`
+	Failures []struct {
+		ID     string          `json:"id"`
+		Status int             `json:"status"`
+		Cause  json.RawMessage `json:"cause,omitempty"`
+	} `json:"failures"`
+}
+
+// deleteByBuildConfig deletes the documents in the index with the namespace and buildConfigName;
+// which succeeds if the index does not exist yet
+func (s *elasticsearchSink) deleteByBuildConfig(index string, namespace string, name string) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]string{"namespace": namespace}},
+					map[string]interface{}{"term": map[string]string{"buildConfigName": name}},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(query)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal the query of %s/%s to JSON: %v", namespace, name, err)
+	}
+	// lets refresh the index first so that documents indexed just before are found by the query
+	err = s.do(http.MethodPost, s.resolve(index, "_refresh"), "", nil, nil)
+	if err == nil {
+		result := deleteByQueryResponse{}
+		u := s.resolve(index, "_delete_by_query") + "?conflicts=proceed"
+		err = s.do(http.MethodPost, u, "application/json", data, &result)
+		if err == nil && len(result.Failures) > 0 {
+			first := result.Failures[0]
+			answer := newStatusError(http.MethodPost, u, first.Status, first.Cause)
+			answer.Body = fmt.Sprintf("%d documents failed to be deleted such as %s: %s", len(result.Failures), first.ID, answer.Body)
+			// the documents which failed are deleted if retried
+			answer.Retryable = true
+			return answer
+		}
+	}
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// index creates or replaces the document with the given ID
+func (s *elasticsearchSink) index(index string, id string, data []byte) error {
+	err := s.createTemplates()
+	if err != nil {
+		return err
+	}
+	return s.putJSON(s.documentURL(index, id), data)
+}
+
+// documentURL uses /{index}/_doc/{id}
+func (s *elasticsearchSink) documentURL(index string, id string) string {
+	return s.resolve(index, elasticsearchDocType) + "/" + pathEscape(id)
+}
+
+// pathEscape escapes the ID as a single path segment, including any slashes, which
+// url.PathEscape does on newer versions of go
+func pathEscape(id string) string {
+	return strings.Replace(url.QueryEscape(id), "+", "%20", -1)
+}
+
+// bulkResponse is the part of the response of the _bulk API used to detect failed items
+type bulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]bulkResponseItemResult `json:"items"`
+}
+
+type bulkResponseItemResult struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// bulk posts the newline delimited actions to the _bulk API failing if any of the actions failed
+func (s *elasticsearchSink) bulk(body []byte) error {
+	result := bulkResponse{}
+	err := s.do(http.MethodPost, s.resolve("_bulk"), "application/x-ndjson", body, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	// lets report the first failure, retrying if any of the documents may succeed if retried
+	var first *bulkResponseItemResult
+	failed := 0
+	retryable := false
+	for _, item := range result.Items {
+		for _, r := range item {
+			if len(r.Error) == 0 {
+				continue
+			}
+			failed++
+			retryable = retryable || isRetryableStatus(r.Status)
+			if first == nil {
+				first = &bulkResponseItemResult{ID: r.ID, Status: r.Status, Error: r.Error}
+			}
+		}
+	}
+	if first == nil {
+		return fmt.Errorf("Failed to index the documents as the _bulk API reported errors without any failed documents")
+	}
+	answer := newStatusError(http.MethodPost, s.resolve("_bulk"), first.Status, first.Error)
+	answer.Body = fmt.Sprintf("%d of %d documents failed such as %s: %s", failed, len(result.Items), first.ID, answer.Body)
+	answer.Retryable = retryable
+	return answer
+}
+
+// writeBulkIndex writes the index action and the document for the _bulk API
+func writeBulkIndex(buffer *bytes.Buffer, index string, id string, doc interface{}) error {
+	action := map[string]map[string]string{
+		"index": {
+			"_index": index,
+			"_id":    id,
+		},
+	}
+	for _, value := range []interface{}{action, doc} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal the _bulk request to JSON: %v", err)
+		}
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+	}
+	return nil
+}
+
+// createTemplates creates the index templates unless they have already been created
+func (s *elasticsearchSink) createTemplates() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.templatesCreated {
+		return nil
+	}
+	templates := map[string]map[string]interface{}{
+		s.options.BuildConfigIndex: buildConfigMappings,
+		s.options.CommitIndex:      commitMappings,
+		s.options.RewriteIndex:     rewriteMappings,
+	}
+	for index, mappings := range templates {
+		template := map[string]interface{}{
+			"index_patterns": []string{index},
+			"mappings":       mappings,
+		}
+		data, err := json.Marshal(template)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal the index template of %s to JSON: %v", index, err)
+		}
+		// the error is not wrapped so that it can still be retried
+		err = s.putJSON(s.resolve("_template", index), data)
+		if err != nil {
+			return err
+		}
+	}
+	s.templatesCreated = true
+	return nil
+}
+
+// buildConfigID is the ID of the document of a BuildConfig
+func buildConfigID(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// commitID is the ID of the document of a commit which includes the BuildConfig
+// as the same commit can be published for many BuildConfigs
+func commitID(dto *BuildConfigCommit) string {
+	return buildConfigID(dto.Namespace, dto.BuildConfigName) + "/" + dto.Hash
+}
+
+var (
+	keywordMapping = map[string]interface{}{"type": "keyword"}
+	textMapping    = map[string]interface{}{"type": "text"}
+	dateMapping    = map[string]interface{}{"type": "date"}
+
+	signatureMapping = map[string]interface{}{
+		"properties": map[string]interface{}{
+			"name":  keywordMapping,
+			"email": keywordMapping,
+			"when":  dateMapping,
+		},
+	}
+
+	buildConfigMappings = map[string]interface{}{
+		"properties": map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"namespace":         keywordMapping,
+					"name":              keywordMapping,
+					"creationTimestamp": dateMapping,
+				},
+			},
+		},
+	}
+
+	commitMappings = map[string]interface{}{
+		"properties": map[string]interface{}{
+			"namespace":       keywordMapping,
+			"buildConfigName": keywordMapping,
+			"hash":            keywordMapping,
+			"message":         textMapping,
+			"author":          signatureMapping,
+			"committer":       signatureMapping,
+			"paths":           keywordMapping,
+		},
+	}
+
+	rewriteMappings = map[string]interface{}{
+		"properties": map[string]interface{}{
+			"namespace":       keywordMapping,
+			"buildConfigName": keywordMapping,
+			"ref":             keywordMapping,
+			"oldHash":         keywordMapping,
+			"newHash":         keywordMapping,
+			"when":            dateMapping,
+		},
+	}
+)
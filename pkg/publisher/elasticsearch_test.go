@@ -0,0 +1,126 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElasticsearchBulk(t *testing.T) {
+	item := func(id string, status int, failed bool) string {
+		if failed {
+			return fmt.Sprintf(`{"index": {"_id": %q, "status": %d, "error": {"type": "failure"}}}`, id, status)
+		}
+		return fmt.Sprintf(`{"index": {"_id": %q, "status": %d}}`, id, status)
+	}
+	response := func(errors bool, items ...string) string {
+		return fmt.Sprintf(`{"errors": %v, "items": [%s]}`, errors, strings.Join(items, ","))
+	}
+	tests := []struct {
+		name       string
+		statusCode int
+		response   string
+		succeeds   bool
+		retryable  bool
+		message    string
+	}{
+		{
+			name:       "all indexed",
+			statusCode: 200,
+			response:   response(false, item("a", 201, false), item("b", 200, false)),
+			succeeds:   true,
+		},
+		{
+			name:       "rejected request",
+			statusCode: 400,
+			response:   `{"error": "bad request"}`,
+			message:    "status code 400",
+		},
+		{
+			name:       "unavailable",
+			statusCode: 503,
+			response:   `{"error": "unavailable"}`,
+			retryable:  true,
+			message:    "status code 503",
+		},
+		{
+			name:       "a document failed",
+			statusCode: 200,
+			response:   response(true, item("a", 201, false), item("b", 400, true)),
+			message:    "1 of 2 documents failed such as b",
+		},
+		{
+			name:       "a document may succeed if retried",
+			statusCode: 200,
+			response:   response(true, item("a", 400, true), item("b", 429, true)),
+			retryable:  true,
+			message:    "2 of 2 documents failed such as a",
+		},
+		{
+			name:       "response cut short",
+			statusCode: 200,
+			response:   `{"errors": false, "items": [`,
+			retryable:  true,
+			message:    "unable to parse the response",
+		},
+		{
+			name:       "errors without failed documents",
+			statusCode: 200,
+			response:   response(true, item("a", 201, false)),
+			message:    "without any failed documents",
+		},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/_bulk", r.URL.Path, test.name)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(test.statusCode)
+			w.Write([]byte(test.response))
+		}))
+		sink, err := NewElasticsearchSink("elasticsearch", server.URL, HTTPOptions{}, ElasticsearchOptions{})
+		if assert.NoError(t, err, test.name) {
+			err = sink.(*elasticsearchSink).bulk([]byte("{}\n"))
+			if test.succeeds {
+				assert.NoError(t, err, test.name)
+			} else if assert.Error(t, err, test.name) {
+				assert.Equal(t, test.retryable, IsRetryable(err), test.name)
+				assert.Contains(t, err.Error(), test.message, test.name)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestPathEscape(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{"myproject", "myproject"},
+		{"myproject/mybc/0123abcd", "myproject%2Fmybc%2F0123abcd"},
+		{"a b+c", "a%20b%2Bc"},
+		{"a?b#c", "a%3Fb%23c"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, pathEscape(test.id))
+	}
+}
@@ -0,0 +1,140 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// maxErrorBody is the maximum number of bytes of a response body included in an error
+	maxErrorBody = 512
+)
+
+// PublishError is the failure of a request to a sink. Failures which may succeed if the request
+// is sent again, such as connection errors, 429 and 5xx responses, are retryable. Other failures
+// such as 4xx responses are permanent as sending the same request again fails the same way
+type PublishError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Body is the start of the response body which usually says why the request failed
+	Body      string
+	Retryable bool
+	Err       error
+}
+
+func (e *PublishError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Failed to %s %s due to: %v", e.Method, e.URL, e.Err)
+	}
+	message := fmt.Sprintf("Failed to %s %s with status code %d", e.Method, e.URL, e.StatusCode)
+	if len(e.Body) > 0 {
+		message += ": " + e.Body
+	}
+	return message
+}
+
+// newStatusError returns the error for a response which was not successful
+func newStatusError(method string, u string, statusCode int, body []byte) *PublishError {
+	return &PublishError{
+		Method:     method,
+		URL:        u,
+		StatusCode: statusCode,
+		Body:       truncateBody(body),
+		Retryable:  isRetryableStatus(statusCode),
+	}
+}
+
+// isRetryableStatus returns true if a request which failed with the status code may succeed
+// if its sent again
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// truncateBody returns the body as a single line of at most maxErrorBody bytes
+func truncateBody(body []byte) string {
+	truncated := len(body) > maxErrorBody
+	if truncated {
+		body = body[:maxErrorBody]
+		// lets not split a multi byte character
+		for len(body) > 0 && !utf8.Valid(body) {
+			body = body[:len(body)-1]
+		}
+	}
+	text := strings.Join(strings.Fields(string(body)), " ")
+	if truncated {
+		text += "..."
+	}
+	return text
+}
+
+// sinkErrors are the errors of the sinks which failed to publish
+type sinkErrors struct {
+	errors map[string]error
+	names  []string
+}
+
+func (e *sinkErrors) Error() string {
+	messages := []string{}
+	for _, name := range e.names {
+		messages = append(messages, fmt.Sprintf("%s: %v", name, e.errors[name]))
+	}
+	return "Failed to publish to " + strings.Join(messages, "; ")
+}
+
+// IsRetryable returns true if publishing failed in a way which may succeed if its retried.
+// When publishing to many sinks it returns true if any of them may succeed if retried
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *PublishError:
+		return e.Retryable
+	case *sinkErrors:
+		for _, sinkErr := range e.errors {
+			if IsRetryable(sinkErr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsPermanent returns true if publishing failed in a way which fails the same way if its retried,
+// such as a 4xx response. When publishing to many sinks it returns true if none of them may
+// succeed if retried. Other errors, like failing to write to the outbox, are not permanent
+func IsPermanent(err error) bool {
+	switch e := err.(type) {
+	case *PublishError:
+		return !e.Retryable
+	case *sinkErrors:
+		for _, sinkErr := range e.errors {
+			if !IsPermanent(sinkErr) {
+				return false
+			}
+		}
+		return len(e.errors) > 0
+	}
+	return false
+}
+
+// isNotFound returns true if the error is a 404 response
+func isNotFound(err error) bool {
+	e, ok := err.(*PublishError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
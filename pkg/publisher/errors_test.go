@@ -0,0 +1,117 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewStatusError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		retryable  bool
+	}{
+		{400, false},
+		{401, false},
+		{403, false},
+		{404, false},
+		{408, true},
+		{409, false},
+		{413, false},
+		{429, true},
+		{500, true},
+		{502, true},
+		{503, true},
+	}
+	for _, test := range tests {
+		err := newStatusError("PUT", "http://sink/doc", test.statusCode, []byte("{\"error\": \"failed\"}"))
+		assert.Equal(t, test.retryable, IsRetryable(err), "status code %d", test.statusCode)
+		assert.Equal(t, !test.retryable, IsPermanent(err), "status code %d", test.statusCode)
+		assert.Equal(t, test.statusCode, err.StatusCode)
+	}
+}
+
+func TestPublishErrorClassification(t *testing.T) {
+	retryable := &PublishError{Method: "PUT", URL: "http://sink/doc", Retryable: true, Err: errors.New("connection refused")}
+	permanent := newStatusError("PUT", "http://sink/doc", 400, nil)
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		permanent bool
+	}{
+		{"no error", nil, false, false},
+		{"other error", errors.New("Failed to write the outbox"), false, false},
+		{"connection error", retryable, true, false},
+		{"bad request", permanent, false, true},
+		{"no sinks", &sinkErrors{errors: map[string]error{}}, false, false},
+		{"all sinks retryable", &sinkErrors{errors: map[string]error{"a": retryable, "b": retryable}}, true, false},
+		{"all sinks permanent", &sinkErrors{errors: map[string]error{"a": permanent, "b": permanent}}, false, true},
+		{"some sinks retryable", &sinkErrors{errors: map[string]error{"a": retryable, "b": permanent}}, true, false},
+		{"some sinks with other errors", &sinkErrors{errors: map[string]error{"a": errors.New("failed"), "b": permanent}}, false, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.retryable, IsRetryable(test.err), test.name)
+		assert.Equal(t, test.permanent, IsPermanent(test.err), test.name)
+	}
+}
+
+func TestPublishErrorMessage(t *testing.T) {
+	tests := []struct {
+		err      *PublishError
+		expected string
+	}{
+		{
+			&PublishError{Method: "PUT", URL: "http://sink/doc", Err: errors.New("connection refused")},
+			"Failed to PUT http://sink/doc due to: connection refused",
+		},
+		{
+			newStatusError("PUT", "http://sink/doc", 404, nil),
+			"Failed to PUT http://sink/doc with status code 404",
+		},
+		{
+			newStatusError("PUT", "http://sink/doc", 400, []byte("{\n  \"error\": \"bad\"\n}\n")),
+			"Failed to PUT http://sink/doc with status code 400: { \"error\": \"bad\" }",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.err.Error())
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	long := strings.Repeat("a", maxErrorBody+10)
+	// a multi byte character which would be split by truncating at maxErrorBody bytes
+	split := strings.Repeat("a", maxErrorBody-1) + "é"
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"single line", "  not found \n", "not found"},
+		{"many lines", "line one\nline two\r\n\tline three", "line one line two line three"},
+		{"long", long, strings.Repeat("a", maxErrorBody) + "..."},
+		{"multi byte character", split, strings.Repeat("a", maxErrorBody-1) + "..."},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, truncateBody([]byte(test.body)), test.name)
+	}
+}
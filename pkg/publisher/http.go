@@ -0,0 +1,281 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+)
+
+const (
+	// ServiceAccountTokenFile is where the token of the service account of the pod is mounted
+	ServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// HTTPOptions configures how a sink authenticates and connects to its destination
+type HTTPOptions struct {
+	Auth AuthOptions
+	TLS  TLSOptions
+	// Timeout is how long each request can take including reading the response which defaults to 30s
+	Timeout time.Duration
+}
+
+// AuthOptions are the credentials sent with each request; either a bearer token
+// or a username and password for basic authentication
+type AuthOptions struct {
+	BearerToken string `json:"bearerToken,omitempty"`
+	// BearerTokenFile is read for each request so that the token can be rotated
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+	// ServiceAccountToken uses the token of the service account of the pod as the bearer token
+	ServiceAccountToken bool   `json:"serviceAccountToken,omitempty"`
+	Username            string `json:"username,omitempty"`
+	Password            string `json:"password,omitempty"`
+}
+
+// Validate returns an error if the options are inconsistent
+func (a *AuthOptions) Validate() error {
+	tokens := 0
+	for _, bearer := range []bool{len(a.BearerToken) > 0, len(a.BearerTokenFile) > 0, a.ServiceAccountToken} {
+		if bearer {
+			tokens++
+		}
+	}
+	bearer := tokens > 0
+	basic := len(a.Username) > 0 || len(a.Password) > 0
+	if tokens > 1 {
+		return fmt.Errorf("only one of bearerToken, bearerTokenFile or serviceAccountToken can be used")
+	}
+	if bearer && basic {
+		return fmt.Errorf("a bearer token can't be used with a username and password")
+	}
+	if basic && len(a.Username) == 0 {
+		return fmt.Errorf("a username is needed with the password")
+	}
+	return nil
+}
+
+// authorize adds the credentials to the request
+func (a *AuthOptions) authorize(req *http.Request) error {
+	token := a.BearerToken
+	tokenFile := a.BearerTokenFile
+	if a.ServiceAccountToken {
+		tokenFile = ServiceAccountTokenFile
+	}
+	if len(tokenFile) > 0 {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read the bearer token file %s due to %v", tokenFile, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if len(a.Username) > 0 {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	return nil
+}
+
+// TLSOptions configures how https connections are verified and the client certificate presented
+type TLSOptions struct {
+	// CAFile is a PEM bundle of the certificate authorities trusted as well as the system ones
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// Validate returns an error if the options are inconsistent
+func (t *TLSOptions) Validate() error {
+	if (len(t.CertFile) > 0) != (len(t.KeyFile) > 0) {
+		return fmt.Errorf("certFile and keyFile must be used together")
+	}
+	if t.InsecureSkipVerify && len(t.CAFile) > 0 {
+		return fmt.Errorf("caFile has no effect when insecureSkipVerify is enabled")
+	}
+	return nil
+}
+
+// enabled returns true if any TLS options are given
+func (t *TLSOptions) enabled() bool {
+	return len(t.CAFile) > 0 || len(t.CertFile) > 0 || t.InsecureSkipVerify
+}
+
+// newClient creates the HTTP client using the TLS options
+func (t *TLSOptions) newClient(timeout time.Duration) (*http.Client, error) {
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	if !t.enabled() {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if len(t.CAFile) > 0 {
+		data, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the CA file %s due to %v", t.CAFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No PEM certificates found in the CA file %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if len(t.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the client certificate %s due to %v", t.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// httpSink is the base of the sinks which publish JSON over HTTP
+type httpSink struct {
+	name   string
+	url    *url.URL
+	client *http.Client
+	auth   AuthOptions
+}
+
+func newHTTPSink(name string, rawUrl string, options HTTPOptions) (httpSink, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return httpSink{}, fmt.Errorf("Cannot parse the %s URL %s due to: %v", name, rawUrl, err)
+	}
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return httpSink{}, fmt.Errorf("Invalid %s URL %s as it has no scheme or host", name, rawUrl)
+	}
+	err = options.Auth.Validate()
+	if err != nil {
+		return httpSink{}, fmt.Errorf("Invalid authentication of %s due to %v", name, err)
+	}
+	err = options.TLS.Validate()
+	if err != nil {
+		return httpSink{}, fmt.Errorf("Invalid TLS configuration of %s due to %v", name, err)
+	}
+	client, err := options.TLS.newClient(options.Timeout)
+	if err != nil {
+		return httpSink{}, fmt.Errorf("Invalid TLS configuration of %s due to %v", name, err)
+	}
+	return httpSink{
+		name:   name,
+		url:    u,
+		client: client,
+		auth:   options.Auth,
+	}, nil
+}
+
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+// resolve returns the URL of the path inside the base URL of the sink
+func (s *httpSink) resolve(elem ...string) string {
+	u := *s.url
+	u.Path = path.Join(append([]string{"/", u.Path}, elem...)...)
+	return u.String()
+}
+
+func (s *httpSink) putJSON(u string, data []byte) error {
+	return s.do(http.MethodPut, u, "application/json", data, nil)
+}
+
+// delete deletes the resource at the URL which succeeds if it does not exist
+func (s *httpSink) delete(u string) error {
+	err := s.do(http.MethodDelete, u, "", nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// do sends the request decoding the JSON response into the result if its not nil.
+// Any response which is not a 2xx is returned as a PublishError
+func (s *httpSink) do(method string, u string, contentType string, data []byte, result interface{}) error {
+	util.Infof("%s %s\n", method, u)
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", contentType)
+		req.ContentLength = int64(len(data))
+	}
+	err = s.auth.authorize(req)
+	if err != nil {
+		// the token file may be missing while its being rotated so lets retry
+		return &PublishError{
+			Method:    method,
+			URL:       u,
+			Retryable: true,
+			Err:       err,
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &PublishError{
+			Method:    method,
+			URL:       u,
+			Retryable: true,
+			Err:       err,
+		}
+	}
+	defer resp.Body.Close()
+	util.Infof("Got result %d\n", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+		return newStatusError(method, u, resp.StatusCode, body)
+	}
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			// the response may have been cut short or come from a proxy so lets retry
+			return &PublishError{
+				Method:    method,
+				URL:       u,
+				Retryable: true,
+				Err:       fmt.Errorf("unable to parse the response: %v", err),
+			}
+		}
+	}
+	return nil
+}
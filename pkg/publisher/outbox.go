@@ -0,0 +1,451 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+const (
+	defaultRetryBackoff = 1 * time.Second
+
+	// outboxFailedDir is the directory inside the outbox the entries which failed permanently are moved to
+	outboxFailedDir = "failed"
+	outboxSuffix    = ".json"
+	// tmpSuffix is appended to an outbox file while it is being written
+	tmpSuffix = ".tmp"
+
+	entryBuildConfig       = "buildConfig"
+	entryGitCommits        = "gitCommits"
+	entryHistoryRewritten  = "historyRewritten"
+	entryDeleteBuildConfig = "deleteBuildConfig"
+	entryDeleteGitCommits  = "deleteGitCommits"
+)
+
+var unsafeDirChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// RetryOptions configures how failed publishes are retried; the delay doubles
+// after each failure from Backoff up to MaxBackoff with some random jitter
+type RetryOptions struct {
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// withDefaults returns a copy of the options with any missing values defaulted
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.Backoff <= 0 {
+		o.Backoff = defaultRetryBackoff
+	}
+	if o.MaxBackoff < o.Backoff {
+		o.MaxBackoff = o.Backoff
+	}
+	return o
+}
+
+// delay returns the delay before the given retry attempt; which is between half and all of
+// the exponential backoff so that many failures don't all retry at the same time
+func (o RetryOptions) delay(attempts int) time.Duration {
+	delay := o.Backoff
+	for i := 1; i < attempts && delay < o.MaxBackoff; i++ {
+		delay = delay * 2
+	}
+	if delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// outboxEntry is a publish waiting to be delivered which is stored as a JSON file
+type outboxEntry struct {
+	Kind string `json:"kind"`
+	// BuildConfig is the v1 JSON of the BuildConfig
+	BuildConfig json.RawMessage      `json:"buildConfig,omitempty"`
+	Commits     []*BuildConfigCommit `json:"commits,omitempty"`
+	Rewrite     *HistoryRewritten    `json:"rewrite,omitempty"`
+	Namespace   string               `json:"namespace,omitempty"`
+	Name        string               `json:"name,omitempty"`
+}
+
+// pendingEntry is the sequence number of an entry in the outbox and when it was queued
+type pendingEntry struct {
+	seq    uint64
+	queued time.Time
+}
+
+// OutboxStatus is the state of the delivery of an outbox
+type OutboxStatus struct {
+	Sink string
+	// Depth is the number of publishes waiting to be delivered
+	Depth int
+	// Oldest is when the oldest publish waiting to be delivered was queued
+	Oldest time.Time
+	// Retries is the number of times delivery has been retried
+	Retries int64
+	// Failed is the number of publishes which failed permanently
+	Failed int64
+}
+
+// Outbox is a Sink which durably queues publishes in a directory before delivering them in
+// order to another Sink. Publishing only fails if the publish can't be stored so queued
+// publishes survive restarts. Deliveries which fail in a way which can be retried are retried
+// with exponential backoff; while those which fail permanently are moved to the failed directory
+type Outbox struct {
+	dir   string
+	sink  Sink
+	retry RetryOptions
+	wake  chan struct{}
+
+	// lock guards the queue of pending entries and the counters
+	lock    sync.Mutex
+	pending []pendingEntry
+	nextSeq uint64
+	retries int64
+	failed  int64
+}
+
+// NewOutboxes creates an Outbox for each of the sinks in a sub directory of the directory named
+// after the sink; so that each sink has its own queue and retry state and a sink which is down
+// does not delay publishing to the other sinks
+func NewOutboxes(dir string, sinks []Sink, retry RetryOptions) ([]*Outbox, error) {
+	answer := []*Outbox{}
+	dirNames := map[string]string{}
+	for _, sink := range sinks {
+		dirName := outboxDirName(sink.Name())
+		if other, ok := dirNames[dirName]; ok {
+			return nil, fmt.Errorf("The sinks %s and %s need different names", other, sink.Name())
+		}
+		dirNames[dirName] = sink.Name()
+		outbox, err := NewOutbox(filepath.Join(dir, dirName), sink, retry)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, outbox)
+	}
+	return answer, nil
+}
+
+// outboxDirName returns the directory name of the outbox of a sink
+func outboxDirName(sinkName string) string {
+	return strings.Trim(unsafeDirChars.ReplaceAllString(strings.ToLower(sinkName), "-"), "-.")
+}
+
+// NewOutbox creates an Outbox which stores its queue in the directory and delivers to the sink
+func NewOutbox(dir string, sink Sink, retry RetryOptions) (*Outbox, error) {
+	err := os.MkdirAll(filepath.Join(dir, outboxFailedDir), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create outbox directory %s due to: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read outbox directory %s due to: %v", dir, err)
+	}
+	o := &Outbox{
+		dir:     dir,
+		sink:    sink,
+		retry:   retry.withDefaults(),
+		wake:    make(chan struct{}, 1),
+		pending: []pendingEntry{},
+		nextSeq: 1,
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() && strings.HasSuffix(name, outboxSuffix+tmpSuffix) {
+			// the operator stopped while writing the entry so it was never queued
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				util.Warnf("Failed to remove the partially written outbox file %s due to: %v\n", name, err)
+			}
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, outboxSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, outboxSuffix), 10, 64)
+		if err != nil {
+			util.Warnf("Ignoring unexpected file %s in the outbox %s\n", name, dir)
+			continue
+		}
+		o.pending = append(o.pending, pendingEntry{seq: seq, queued: file.ModTime()})
+		if seq >= o.nextSeq {
+			o.nextSeq = seq + 1
+		}
+	}
+	sort.Sort(bySeq(o.pending))
+	if len(o.pending) > 0 {
+		util.Infof("Resuming delivery of %d publishes to %s from the outbox %s\n", len(o.pending), sink.Name(), dir)
+	}
+	return o, nil
+}
+
+func (o *Outbox) Name() string {
+	return o.sink.Name()
+}
+
+func (o *Outbox) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
+	data, err := marshalBuildConfig(bc)
+	if err != nil {
+		return err
+	}
+	return o.enqueue(&outboxEntry{Kind: entryBuildConfig, BuildConfig: data})
+}
+
+func (o *Outbox) UpsertGitCommits(dtos []*BuildConfigCommit) error {
+	if len(dtos) == 0 {
+		return nil
+	}
+	return o.enqueue(&outboxEntry{Kind: entryGitCommits, Commits: dtos})
+}
+
+func (o *Outbox) UpsertHistoryRewritten(dto *HistoryRewritten) error {
+	return o.enqueue(&outboxEntry{Kind: entryHistoryRewritten, Rewrite: dto})
+}
+
+func (o *Outbox) DeleteBuildConfig(namespace string, name string) error {
+	return o.enqueue(&outboxEntry{Kind: entryDeleteBuildConfig, Namespace: namespace, Name: name})
+}
+
+func (o *Outbox) DeleteGitCommits(namespace string, name string) error {
+	return o.enqueue(&outboxEntry{Kind: entryDeleteGitCommits, Namespace: namespace, Name: name})
+}
+
+// Status returns the current state of the delivery of the outbox
+func (o *Outbox) Status() OutboxStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	answer := OutboxStatus{
+		Sink:    o.sink.Name(),
+		Depth:   len(o.pending),
+		Retries: o.retries,
+		Failed:  o.failed,
+	}
+	if len(o.pending) > 0 {
+		answer.Oldest = o.pending[0].queued
+	}
+	return answer
+}
+
+// enqueue stores the entry at the end of the queue
+func (o *Outbox) enqueue(entry *outboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal outbox entry to JSON: %v", err)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	seq := o.nextSeq
+	err = writeFileSync(o.fileName(seq), data)
+	if err != nil {
+		return err
+	}
+	o.nextSeq++
+	o.pending = append(o.pending, pendingEntry{seq: seq, queued: time.Now()})
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeFileSync writes the file so that it is either complete or missing after a crash; it is
+// written to a temporary file which is synced to disk before it is renamed, then the directory
+// is synced so the rename is on disk before the caller relies on the file
+func writeFileSync(fileName string, data []byte) error {
+	tmpFile := fileName + tmpSuffix
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create outbox file %s due to: %v", tmpFile, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to write outbox file %s due to: %v", tmpFile, err)
+	}
+	err = os.Rename(tmpFile, fileName)
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("Failed to rename outbox file %s due to: %v", tmpFile, err)
+	}
+	return syncDir(filepath.Dir(fileName))
+}
+
+// syncDir syncs the directory so that the files renamed into it are on disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to open outbox directory %s due to: %v", dir, err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil && runtime.GOOS != "windows" {
+		// windows does not support syncing directories
+		return fmt.Errorf("Failed to sync outbox directory %s due to: %v", dir, err)
+	}
+	return nil
+}
+
+func (o *Outbox) fileName(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, outboxSuffix))
+}
+
+// head returns the oldest pending entry
+func (o *Outbox) head() (pendingEntry, bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.pending) == 0 {
+		return pendingEntry{}, false
+	}
+	return o.pending[0], true
+}
+
+// pop removes the oldest pending entry; moving it to the failed directory if it failed permanently
+func (o *Outbox) pop(failed bool) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.pending) == 0 {
+		return
+	}
+	seq := o.pending[0].seq
+	o.pending = o.pending[1:]
+	fileName := o.fileName(seq)
+	var err error
+	if failed {
+		o.failed++
+		err = os.Rename(fileName, filepath.Join(o.dir, outboxFailedDir, filepath.Base(fileName)))
+	} else {
+		err = os.Remove(fileName)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		util.Warnf("Failed to remove outbox file %s due to: %v\n", fileName, err)
+	}
+}
+
+// Run delivers the queued publishes in order until the channel is closed
+func (o *Outbox) Run(stopCh <-chan struct{}) {
+	if starter, ok := o.sink.(Starter); ok {
+		err := starter.Start()
+		if err != nil {
+			util.Warnf("Failed to start publishing to %s due to %v\n", o.sink.Name(), err)
+		}
+	}
+	attempts := 0
+	for {
+		entry, ok := o.head()
+		if !ok {
+			select {
+			case <-stopCh:
+				return
+			case <-o.wake:
+				continue
+			}
+		}
+		err := o.deliver(entry.seq)
+		if err == nil {
+			attempts = 0
+			o.pop(false)
+			continue
+		}
+		if _, invalid := err.(*invalidEntryError); invalid || IsPermanent(err) {
+			util.Errorf("Giving up publishing %s to %s as it failed permanently due to %v\n", o.fileName(entry.seq), o.sink.Name(), err)
+			attempts = 0
+			o.pop(true)
+			continue
+		}
+		attempts++
+		delay := o.retry.delay(attempts)
+		o.lock.Lock()
+		o.retries++
+		depth := len(o.pending)
+		o.lock.Unlock()
+		util.Warnf("Failed to publish to %s with %d publishes queued so retrying in %v due to %v\n", o.sink.Name(), depth, delay, err)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// invalidEntryError is an outbox file which can't be read so it can never be published
+type invalidEntryError struct {
+	fileName string
+	err      error
+}
+
+func (e *invalidEntryError) Error() string {
+	return fmt.Sprintf("Failed to read outbox file %s due to: %v", e.fileName, e.err)
+}
+
+// deliver publishes the entry to the sink
+func (o *Outbox) deliver(seq uint64) error {
+	fileName := o.fileName(seq)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return &invalidEntryError{fileName: fileName, err: err}
+	}
+	entry := outboxEntry{}
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return &invalidEntryError{fileName: fileName, err: err}
+	}
+	switch entry.Kind {
+	case entryBuildConfig:
+		bc, err := unmarshalBuildConfig(entry.BuildConfig)
+		if err != nil {
+			return &invalidEntryError{fileName: fileName, err: err}
+		}
+		return o.sink.UpsertBuildConfig(bc)
+	case entryGitCommits:
+		return o.sink.UpsertGitCommits(entry.Commits)
+	case entryHistoryRewritten:
+		return o.sink.UpsertHistoryRewritten(entry.Rewrite)
+	case entryDeleteBuildConfig:
+		return o.sink.DeleteBuildConfig(entry.Namespace, entry.Name)
+	case entryDeleteGitCommits:
+		return o.sink.DeleteGitCommits(entry.Namespace, entry.Name)
+	default:
+		return &invalidEntryError{fileName: fileName, err: fmt.Errorf("unknown kind %s", entry.Kind)}
+	}
+}
+
+type bySeq []pendingEntry
+
+func (c bySeq) Len() int           { return len(c) }
+func (c bySeq) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c bySeq) Less(i, j int) bool { return c[i].seq < c[j].seq }
@@ -0,0 +1,359 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+// fakeSink records the publishes delivered to it and fails them with the queued errors
+type fakeSink struct {
+	lock      sync.Mutex
+	errors    []error
+	delivered []string
+	calls     chan string
+}
+
+func newFakeSink(errors ...error) *fakeSink {
+	return &fakeSink{
+		errors:    errors,
+		delivered: []string{},
+		calls:     make(chan string, 100),
+	}
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) publish(text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	if len(s.errors) > 0 {
+		err = s.errors[0]
+		s.errors = s.errors[1:]
+	}
+	if err == nil {
+		s.delivered = append(s.delivered, text)
+	}
+	s.calls <- text
+	return err
+}
+
+func (s *fakeSink) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
+	return s.publish("buildConfig " + bc.Namespace + "/" + bc.Name)
+}
+
+func (s *fakeSink) UpsertGitCommits(dtos []*BuildConfigCommit) error {
+	text := "commits"
+	for _, dto := range dtos {
+		text += " " + dto.Hash
+	}
+	return s.publish(text)
+}
+
+func (s *fakeSink) UpsertHistoryRewritten(dto *HistoryRewritten) error {
+	return s.publish("rewrite " + dto.Namespace + "/" + dto.BuildConfigName)
+}
+
+func (s *fakeSink) DeleteBuildConfig(namespace string, name string) error {
+	return s.publish("deleteBuildConfig " + namespace + "/" + name)
+}
+
+func (s *fakeSink) DeleteGitCommits(namespace string, name string) error {
+	return s.publish("deleteGitCommits " + namespace + "/" + name)
+}
+
+// waitForCalls waits for the sink to be called the given number of times
+func (s *fakeSink) waitForCalls(t *testing.T, count int) []string {
+	answer := []string{}
+	for len(answer) < count {
+		select {
+		case call := <-s.calls:
+			answer = append(answer, call)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for %d publishes after %v", count, answer)
+		}
+	}
+	return answer
+}
+
+func (s *fakeSink) Delivered() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.delivered...)
+}
+
+func newTestOutboxDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitcollector-outbox-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	return dir
+}
+
+// publishTestEntries queues publishes of every kind which doesn't need a BuildConfig
+func publishTestEntries(t *testing.T, o *Outbox) {
+	assert.NoError(t, o.UpsertGitCommits([]*BuildConfigCommit{{Hash: "a"}, {Hash: "b"}}))
+	assert.NoError(t, o.UpsertHistoryRewritten(&HistoryRewritten{Namespace: "myproject", BuildConfigName: "mybc"}))
+	assert.NoError(t, o.UpsertGitCommits([]*BuildConfigCommit{{Hash: "c"}}))
+	assert.NoError(t, o.DeleteGitCommits("myproject", "mybc"))
+	assert.NoError(t, o.DeleteBuildConfig("myproject", "mybc"))
+}
+
+var testEntries = []string{
+	"commits a b",
+	"rewrite myproject/mybc",
+	"commits c",
+	"deleteGitCommits myproject/mybc",
+	"deleteBuildConfig myproject/mybc",
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	defer os.RemoveAll(dir)
+	sink := newFakeSink()
+	o, err := NewOutbox(dir, sink, RetryOptions{Backoff: time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// nothing is published without entries
+	assert.NoError(t, o.UpsertGitCommits([]*BuildConfigCommit{}))
+	publishTestEntries(t, o)
+	assert.Equal(t, len(testEntries), o.Status().Depth)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go o.Run(stopCh)
+	sink.waitForCalls(t, len(testEntries))
+	assert.Equal(t, testEntries, sink.Delivered())
+	waitForDepth(t, o, 0)
+	assert.Equal(t, []string{}, outboxFiles(t, dir))
+}
+
+func TestOutboxRetries(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	defer os.RemoveAll(dir)
+	retryable := &PublishError{Method: "PUT", URL: "http://sink/doc", Retryable: true, Err: errors.New("connection refused")}
+	sink := newFakeSink(retryable, retryable, newStatusError("PUT", "http://sink/doc", 503, nil))
+	o, err := NewOutbox(dir, sink, RetryOptions{Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	publishTestEntries(t, o)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go o.Run(stopCh)
+	calls := sink.waitForCalls(t, len(testEntries)+3)
+	// the first entry is retried until it succeeds before anything else is delivered
+	assert.Equal(t, append([]string{testEntries[0], testEntries[0], testEntries[0]}, testEntries...), calls)
+	assert.Equal(t, testEntries, sink.Delivered())
+	waitForDepth(t, o, 0)
+	status := o.Status()
+	assert.Equal(t, int64(3), status.Retries)
+	assert.Equal(t, int64(0), status.Failed)
+}
+
+func TestOutboxMovesPermanentFailures(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	defer os.RemoveAll(dir)
+	// only the 400 is permanent as an unexpected error may succeed if its retried
+	sink := newFakeSink(nil, newStatusError("PUT", "http://sink/doc", 400, nil), errors.New("Unable to write"))
+	o, err := NewOutbox(dir, sink, RetryOptions{Backoff: time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	publishTestEntries(t, o)
+	// an entry which can't be read can never be published
+	assert.NoError(t, ioutil.WriteFile(o.fileName(4), []byte("{\"kind\": \"deleteGit"), 0600))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go o.Run(stopCh)
+	calls := sink.waitForCalls(t, len(testEntries))
+	assert.Equal(t, []string{testEntries[0], testEntries[1], testEntries[2], testEntries[2], testEntries[4]}, calls)
+	assert.Equal(t, []string{testEntries[0], testEntries[2], testEntries[4]}, sink.Delivered())
+	waitForDepth(t, o, 0)
+	status := o.Status()
+	assert.Equal(t, int64(1), status.Retries)
+	assert.Equal(t, int64(2), status.Failed)
+
+	failed, err := ioutil.ReadDir(filepath.Join(dir, outboxFailedDir))
+	if assert.NoError(t, err) && assert.Len(t, failed, 2) {
+		assert.Equal(t, filepath.Base(o.fileName(2)), failed[0].Name())
+		assert.Equal(t, filepath.Base(o.fileName(4)), failed[1].Name())
+	}
+}
+
+func TestOutboxesRecoverIndependently(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	defer os.RemoveAll(dir)
+	// Elasticsearch fails to create the index templates until it is up
+	var lock sync.Mutex
+	up := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/_template/") && !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	}))
+	defer server.Close()
+	elasticsearch, err := NewElasticsearchSink("elasticsearch", server.URL, HTTPOptions{}, ElasticsearchOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	healthy := newFakeSink()
+	outboxes, err := NewOutboxes(dir, []Sink{elasticsearch, healthy}, RetryOptions{Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, o := range outboxes {
+		assert.NoError(t, o.UpsertGitCommits([]*BuildConfigCommit{{Hash: "a"}}))
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, o := range outboxes {
+		go o.Run(stopCh)
+	}
+	// the healthy sink is not held up by the sink which failed to start
+	healthy.waitForCalls(t, 1)
+	assert.Equal(t, []string{"commits a"}, healthy.Delivered())
+	waitForDepth(t, outboxes[1], 0)
+	for i := 0; i < 1000 && outboxes[0].Status().Retries == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := outboxes[0].Status()
+	assert.Equal(t, 1, status.Depth)
+	assert.NotEqual(t, int64(0), status.Retries)
+
+	lock.Lock()
+	up = true
+	lock.Unlock()
+	waitForDepth(t, outboxes[0], 0)
+	assert.Equal(t, int64(0), outboxes[0].Status().Failed, "the failures to create the templates should be retried")
+}
+
+func TestOutboxResumesAfterRestart(t *testing.T) {
+	dir := newTestOutboxDir(t)
+	defer os.RemoveAll(dir)
+	o, err := NewOutbox(dir, newFakeSink(), RetryOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	publishTestEntries(t, o)
+	// the operator stopped while writing an entry and something else wrote to the directory
+	partial := o.fileName(6) + tmpSuffix
+	assert.NoError(t, ioutil.WriteFile(partial, []byte("{\"kind\": \"gitCom"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.json"), []byte("{}"), 0600))
+
+	sink := newFakeSink()
+	o, err = NewOutbox(dir, sink, RetryOptions{Backoff: time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = os.Stat(partial)
+	assert.True(t, os.IsNotExist(err), "the partially written entry should be removed")
+	assert.Equal(t, len(testEntries), o.Status().Depth)
+
+	// new entries are queued after the existing ones
+	assert.NoError(t, o.UpsertGitCommits([]*BuildConfigCommit{{Hash: "d"}}))
+	assert.Equal(t, o.fileName(6), o.fileName(o.nextSeq-1))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go o.Run(stopCh)
+	sink.waitForCalls(t, len(testEntries)+1)
+	assert.Equal(t, append(append([]string{}, testEntries...), "commits d"), sink.Delivered())
+	waitForDepth(t, o, 0)
+	assert.Equal(t, []string{"notes.json"}, outboxFiles(t, dir))
+}
+
+func TestRetryDelay(t *testing.T) {
+	options := RetryOptions{Backoff: time.Second, MaxBackoff: 10 * time.Second}.withDefaults()
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{20, 10 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := options.delay(test.attempts)
+			assert.True(t, delay >= test.max/2 && delay <= test.max, "attempt %d delay %v should be between %v and %v", test.attempts, delay, test.max/2, test.max)
+		}
+	}
+}
+
+func TestOutboxDirName(t *testing.T) {
+	tests := []struct {
+		sinkName string
+		expected string
+	}{
+		{"elasticsearch", "elasticsearch"},
+		{"WIT", "wit"},
+		{"My Sink/v2", "my-sink-v2"},
+		{"..hidden", "hidden"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, outboxDirName(test.sinkName), test.sinkName)
+	}
+}
+
+// waitForDepth waits for the delivered entries to be removed from the outbox
+func waitForDepth(t *testing.T, o *Outbox, depth int) {
+	for i := 0; i < 1000 && o.Status().Depth != depth; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, depth, o.Status().Depth)
+}
+
+// outboxFiles returns the names of the files in the outbox excluding the failed directory
+func outboxFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	answer := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			answer = append(answer, file.Name())
+		}
+	}
+	return answer
+}
@@ -1,26 +1,19 @@
 package publisher
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
-	"os"
-	"path"
+	"strings"
 	"time"
 
-	"github.com/fabric8io/gitcollector/pkg/util"
-	"k8s.io/kubernetes/pkg/api"
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
 
 	buildapi "github.com/openshift/origin/pkg/build/api"
-	buildapiv1 "github.com/openshift/origin/pkg/build/api/v1"
-	"srcd.works/go-git.v4/plumbing/object"
 )
 
+// Publisher publishes the BuildConfigs and their git commits to every one of its sinks;
+// so that it is itself a Sink
 type Publisher struct {
-	witUrl           string
-	elasticsearchUrl string
+	sinks []Sink
 }
 
 type Signature struct {
@@ -36,185 +29,144 @@ type BuildConfigCommit struct {
 	Message         string    `json:"message,omitempty"`
 	Author          Signature `json:"author,omitempty"`
 	Committer       Signature `json:"committer,omitempty"`
+	// Paths are the files changed in the ContextDir of the BuildConfig
+	Paths []string `json:"paths,omitempty"`
 }
 
-func New() Publisher {
+// HistoryRewritten is published when the history of the ref of a BuildConfig is rewritten,
+// such as by a force push, so that the previous tip is no longer reachable
+type HistoryRewritten struct {
+	Namespace       string    `json:"namespace,omitempty"`
+	BuildConfigName string    `json:"buildConfigName,omitempty"`
+	Ref             string    `json:"ref,omitempty"`
+	OldHash         string    `json:"oldHash,omitempty"`
+	NewHash         string    `json:"newHash,omitempty"`
+	When            time.Time `json:"when,omitempty"`
+}
+
+// New creates a Publisher which fans out to the given sinks
+func New(sinks ...Sink) Publisher {
 	return Publisher{
-		witUrl:           urlFromEnvVars("WIT"),
-		elasticsearchUrl: urlFromEnvVars("ELASTICSEARCH"),
+		sinks: sinks,
 	}
 }
 
-// urlFromEnvVars uses the kubernetes FOO_SERVICE_HOST and FOO_SERVICE_PORT environment
-// variables to find the services for the given name (in capitals)
-func urlFromEnvVars(name string) string {
-	host := os.Getenv(name + "_SERVICE_HOST")
-	answer := ""
-	if len(host) > 0 {
-		port := os.Getenv(name + "_SERVICE_PORT")
-		prefix := "http://"
-
-		if len(port) > 0 {
-			answer = prefix + host + ":" + port + "/"
-		} else {
-			answer = prefix + host + "/"
+// Start starts any sinks which need to prepare their destination; failures are
+// returned but the sinks retry preparing before they next publish
+func (p *Publisher) Start() error {
+	return p.publish(func(sink Sink) error {
+		starter, ok := sink.(Starter)
+		if !ok {
+			return nil
 		}
-	}
-	util.Infof("Accessing %s at URL: %s\n", name, answer)
-	return answer
+		return starter.Start()
+	})
 }
 
-func (p *Publisher) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
-	if bc == nil {
-		return fmt.Errorf("No BuildConfig supplied!")
+// Name returns the names of the sinks
+func (p *Publisher) Name() string {
+	names := []string{}
+	for _, sink := range p.sinks {
+		names = append(names, sink.Name())
 	}
-	u1 := p.buildConfigURLForWIT(bc)
-	u2 := p.buildConfigURLForES(bc)
-	if len(u1) == 0 && len(u2) == 0 {
-		return nil
-	}
-
-	// marshalling from a non v1 does nto generate lower case JSON
-	// so lets convert to v1
-	var v1BC buildapiv1.BuildConfig
-	err := api.Scheme.Convert(bc, &v1BC, nil)
-	if err != nil {
-		return fmt.Errorf("Cannot convert from api to api/v1 of BuildConfig: %v", err)
-	}
-
-	data, err := json.Marshal(&v1BC)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal BuildConfig to JSON: %v", err)
-	}
-
-	err = p.putJSON(u1, &data)
-	if err != nil {
-		return err
-	}
-	err = p.putJSON(u2, &data)
-	return err
+	return strings.Join(names, ", ")
 }
 
-func (p *Publisher) putJSON(u string, data *[]byte) error {
-	if len(u) == 0 {
-		return nil
-	}
-	util.Infof("Putting JSON at %s\n", u)
-	//util.Infof("JSON: %s\n", string(*data))
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(*data))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.ContentLength = int64(len(*data))
-	resp, err := client.Do(req)
-	if err == nil {
-		util.Infof("Got result %d\n", resp.StatusCode)
-		return nil
-	} else {
-		status := -1
-		if resp != nil {
-			status = resp.StatusCode
-		}
-		return fmt.Errorf("Failed to PUT to %s with status code %d due to: %v", u, status, err)
-	}
+// Sinks returns the sinks being published to
+func (p *Publisher) Sinks() []Sink {
+	return p.sinks
 }
 
-func (p *Publisher) UpsertGitCommit(bc *buildapi.BuildConfig, commit *object.Commit) error {
+func (p *Publisher) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
 	if bc == nil {
 		return fmt.Errorf("No BuildConfig supplied!")
 	}
-	if commit == nil {
-		return fmt.Errorf("No Commit supplied!")
-	}
-	dto := BuildConfigCommit{
+	return p.publish(func(sink Sink) error {
+		return sink.UpsertBuildConfig(bc)
+	})
+}
+
+// NewBuildConfigCommit creates the commit published for the BuildConfig
+// with the paths it changed in the ContextDir of the BuildConfig
+func NewBuildConfigCommit(bc *buildapi.BuildConfig, commit *gitbackend.Commit, paths []string) *BuildConfigCommit {
+	return &BuildConfigCommit{
 		Namespace:       bc.Namespace,
 		BuildConfigName: bc.Name,
-		Hash:            commit.Hash.String(),
+		Hash:            commit.Hash,
 		Message:         commit.Message,
 		Author:          NewSignature(&commit.Author),
 		Committer:       NewSignature(&commit.Committer),
+		Paths:           paths,
 	}
+}
 
-	u1 := p.gitCommitURLForWIT(&dto)
-	u2 := p.gitCommitURLForES(&dto)
-	if len(u1) == 0 && len(u2) == 0 {
+// UpsertGitCommits publishes a batch of commits oldest first
+func (p *Publisher) UpsertGitCommits(dtos []*BuildConfigCommit) error {
+	if len(dtos) == 0 {
 		return nil
 	}
+	return p.publish(func(sink Sink) error {
+		return sink.UpsertGitCommits(dtos)
+	})
+}
 
-	data, err := json.Marshal(&dto)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal BuildConfigCommit to JSON: %v", err)
-	}
-	err = p.putJSON(u1, &data)
-	if err != nil {
-		return err
+// NewHistoryRewritten creates the event published when the history of the ref
+// of the BuildConfig is rewritten from the old hash to the new hash
+func NewHistoryRewritten(bc *buildapi.BuildConfig, ref string, oldHash string, newHash string) *HistoryRewritten {
+	return &HistoryRewritten{
+		Namespace:       bc.Namespace,
+		BuildConfigName: bc.Name,
+		Ref:             ref,
+		OldHash:         oldHash,
+		NewHash:         newHash,
+		When:            time.Now(),
 	}
-	err = p.putJSON(u2, &data)
-	return err
 }
 
-func NewSignature(sig *object.Signature) Signature {
-	return Signature{
-		Name:  sig.Name,
-		Email: sig.Email,
-		When:  sig.When,
+func (p *Publisher) UpsertHistoryRewritten(dto *HistoryRewritten) error {
+	if dto == nil {
+		return fmt.Errorf("No HistoryRewritten supplied!")
 	}
+	return p.publish(func(sink Sink) error {
+		return sink.UpsertHistoryRewritten(dto)
+	})
 }
 
-// buildConfigURLForWIT uses /api/userspace/kubernetes/{namespace}/buildconfigs/{buildConfig}
-func (p *Publisher) buildConfigURLForWIT(bc *buildapi.BuildConfig) string {
-	host := p.witUrl
-	if len(host) == 0 {
-		return ""
-	}
-	u, err := url.Parse(host)
-	if err != nil {
-		util.Fatalf("Cannot parse the WIT URL %s due to: %v\n", host, err)
-	}
-	u.Path = path.Join("/api/userspace/kubernetes", bc.Namespace, "/buildconfigs", bc.Name)
-	return u.String()
+// DeleteBuildConfig removes the BuildConfig from every sink
+func (p *Publisher) DeleteBuildConfig(namespace string, name string) error {
+	return p.publish(func(sink Sink) error {
+		return sink.DeleteBuildConfig(namespace, name)
+	})
 }
 
-// buildConfigURLForES uses /api/userspace/kubernetes/{namespace}/buildconfigs/{buildConfig}
-func (p *Publisher) buildConfigURLForES(bc *buildapi.BuildConfig) string {
-	host := p.elasticsearchUrl
-	if len(host) == 0 {
-		return ""
-	}
-	u, err := url.Parse(host)
-	if err != nil {
-		util.Fatalf("Cannot parse the Elasticsearch URL %s due to: %v\n", host, err)
-	}
-	u.Path = path.Join("/index/foo")
-	return u.String()
+// DeleteGitCommits removes the commits of the BuildConfig from every sink
+func (p *Publisher) DeleteGitCommits(namespace string, name string) error {
+	return p.publish(func(sink Sink) error {
+		return sink.DeleteGitCommits(namespace, name)
+	})
 }
 
-// gitCommitURLForWIT uses /api/userspace/git/commits/{namespace}/buildConfig{buildConfigName}/{hash}
-func (p *Publisher) gitCommitURLForWIT(dto *BuildConfigCommit) string {
-	host := p.witUrl
-	if len(host) == 0 {
-		return ""
+// publish invokes the function on every sink even if some of them fail
+// returning an error combining the errors of the sinks which failed
+func (p *Publisher) publish(fn func(sink Sink) error) error {
+	errs := &sinkErrors{errors: map[string]error{}}
+	for _, sink := range p.sinks {
+		err := fn(sink)
+		if err != nil {
+			errs.names = append(errs.names, sink.Name())
+			errs.errors[sink.Name()] = err
+		}
 	}
-	u, err := url.Parse(host)
-	if err != nil {
-		util.Fatalf("Cannot parse the WIT URL %s due to: %v\n", host, err)
+	if len(errs.names) > 0 {
+		return errs
 	}
-	u.Path = path.Join("/api/userspace/git/commits", dto.Namespace, "buildConfig", dto.BuildConfigName, dto.Hash)
-	return u.String()
+	return nil
 }
 
-// gitCommitURLForES uses /api/userspace/git/commits/{namespace}/buildconfigs/{gitCommit}
-func (p *Publisher) gitCommitURLForES(dto *BuildConfigCommit) string {
-	host := p.elasticsearchUrl
-	if len(host) == 0 {
-		return ""
-	}
-	u, err := url.Parse(host)
-	if err != nil {
-		util.Fatalf("Cannot parse the Elasticsearch URL %s due to: %v\n", host, err)
+func NewSignature(sig *gitbackend.Signature) Signature {
+	return Signature{
+		Name:  sig.Name,
+		Email: sig.Email,
+		When:  sig.When,
 	}
-	u.Path = path.Join("/index/foo")
-	return u.String()
 }
@@ -0,0 +1,137 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+	"k8s.io/kubernetes/pkg/api"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+	buildapiv1 "github.com/openshift/origin/pkg/build/api/v1"
+)
+
+const (
+	// the names of the sinks found from the environment variables
+	witSinkName           = "WIT"
+	elasticsearchSinkName = "Elasticsearch"
+)
+
+// Sink is a destination the BuildConfigs and their git commits are published to
+type Sink interface {
+	// Name returns the name of the sink used in logs and errors
+	Name() string
+
+	UpsertBuildConfig(bc *buildapi.BuildConfig) error
+
+	// UpsertGitCommits publishes a batch of commits
+	UpsertGitCommits(dtos []*BuildConfigCommit) error
+
+	UpsertHistoryRewritten(dto *HistoryRewritten) error
+
+	// DeleteBuildConfig removes the BuildConfig with the given namespace and name
+	DeleteBuildConfig(namespace string, name string) error
+
+	// DeleteGitCommits removes the commits and history rewritten events published for the
+	// BuildConfig with the given namespace and name
+	DeleteGitCommits(namespace string, name string) error
+}
+
+// Starter is implemented by the sinks which need to prepare the destination,
+// such as creating index templates, before anything is published
+type Starter interface {
+	Start() error
+}
+
+// EnvSinks returns the sinks for the WIT and Elasticsearch services found using the
+// kubernetes service environment variables. They use https if any TLS options are given
+func EnvSinks(httpOptions HTTPOptions, witOptions WITOptions, esOptions ElasticsearchOptions) ([]Sink, error) {
+	answer := []Sink{}
+	scheme := "http"
+	if httpOptions.TLS.enabled() {
+		scheme = "https"
+	}
+	witUrl := urlFromEnvVars("WIT", scheme)
+	if len(witUrl) > 0 {
+		sink, err := NewWITSink(witSinkName, witUrl, httpOptions, witOptions)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, sink)
+	}
+	esUrl := urlFromEnvVars("ELASTICSEARCH", scheme)
+	if len(esUrl) > 0 {
+		sink, err := NewElasticsearchSink(elasticsearchSinkName, esUrl, httpOptions, esOptions)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, sink)
+	}
+	return answer, nil
+}
+
+// urlFromEnvVars uses the kubernetes FOO_SERVICE_HOST and FOO_SERVICE_PORT environment
+// variables to find the services for the given name (in capitals)
+func urlFromEnvVars(name string, scheme string) string {
+	host := os.Getenv(name + "_SERVICE_HOST")
+	answer := ""
+	if len(host) > 0 {
+		port := os.Getenv(name + "_SERVICE_PORT")
+		prefix := scheme + "://"
+
+		if len(port) > 0 {
+			answer = prefix + host + ":" + port + "/"
+		} else {
+			answer = prefix + host + "/"
+		}
+	}
+	util.Infof("Accessing %s at URL: %s\n", name, answer)
+	return answer
+}
+
+// marshalBuildConfig marshals the BuildConfig as v1 JSON
+func marshalBuildConfig(bc *buildapi.BuildConfig) ([]byte, error) {
+	// marshalling from a non v1 does nto generate lower case JSON
+	// so lets convert to v1
+	var v1BC buildapiv1.BuildConfig
+	err := api.Scheme.Convert(bc, &v1BC, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot convert from api to api/v1 of BuildConfig: %v", err)
+	}
+	data, err := json.Marshal(&v1BC)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal BuildConfig to JSON: %v", err)
+	}
+	return data, nil
+}
+
+// unmarshalBuildConfig parses the v1 JSON of a BuildConfig
+func unmarshalBuildConfig(data []byte) (*buildapi.BuildConfig, error) {
+	var v1BC buildapiv1.BuildConfig
+	err := json.Unmarshal(data, &v1BC)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse BuildConfig JSON: %v", err)
+	}
+	bc := &buildapi.BuildConfig{}
+	err = api.Scheme.Convert(&v1BC, bc, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot convert from api/v1 to api of BuildConfig: %v", err)
+	}
+	return bc, nil
+}
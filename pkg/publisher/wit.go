@@ -0,0 +1,111 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package publisher
+
+import (
+	"encoding/json"
+	"fmt"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+// WITOptions enables the parts of the Work Item Tracker API which are not provided by every
+// version of it so they are off by default
+type WITOptions struct {
+	// PublishRewrites PUTs history rewritten events to /api/userspace/git/rewrites
+	PublishRewrites bool `json:"publishRewrites,omitempty"`
+	// DeleteCommits DELETEs all the commits, and the rewrites if they are published,
+	// of a BuildConfig when they are not retained
+	DeleteCommits bool `json:"deleteCommits,omitempty"`
+}
+
+// witSink publishes to the REST API of the Work Item Tracker
+type witSink struct {
+	httpSink
+	options WITOptions
+}
+
+// NewWITSink creates a Sink with the given name for the Work Item Tracker at the given URL
+func NewWITSink(name string, u string, options HTTPOptions, witOptions WITOptions) (Sink, error) {
+	base, err := newHTTPSink(name, u, options)
+	if err != nil {
+		return nil, err
+	}
+	return &witSink{
+		httpSink: base,
+		options:  witOptions,
+	}, nil
+}
+
+// UpsertBuildConfig uses /api/userspace/kubernetes/{namespace}/buildconfigs/{buildConfig}
+func (s *witSink) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
+	data, err := marshalBuildConfig(bc)
+	if err != nil {
+		return err
+	}
+	return s.putJSON(s.buildConfigURL(bc.Namespace, bc.Name), data)
+}
+
+// UpsertGitCommits uses /api/userspace/git/commits/{namespace}/buildConfig/{buildConfigName}/{hash}
+// for each commit
+func (s *witSink) UpsertGitCommits(dtos []*BuildConfigCommit) error {
+	for _, dto := range dtos {
+		data, err := json.Marshal(dto)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal BuildConfigCommit to JSON: %v", err)
+		}
+		err = s.putJSON(s.resolve("/api/userspace/git/commits", dto.Namespace, "buildConfig", dto.BuildConfigName, dto.Hash), data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpsertHistoryRewritten uses /api/userspace/git/rewrites/{namespace}/buildConfig/{buildConfigName}/{newHash}
+// if publishing rewrites is enabled
+func (s *witSink) UpsertHistoryRewritten(dto *HistoryRewritten) error {
+	if !s.options.PublishRewrites {
+		return nil
+	}
+	data, err := json.Marshal(dto)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal HistoryRewritten to JSON: %v", err)
+	}
+	return s.putJSON(s.resolve("/api/userspace/git/rewrites", dto.Namespace, "buildConfig", dto.BuildConfigName, dto.NewHash), data)
+}
+
+func (s *witSink) DeleteBuildConfig(namespace string, name string) error {
+	return s.delete(s.buildConfigURL(namespace, name))
+}
+
+// DeleteGitCommits uses /api/userspace/git/commits/{namespace}/buildConfig/{buildConfigName}
+// and /api/userspace/git/rewrites/{namespace}/buildConfig/{buildConfigName} if deleting commits
+// and publishing rewrites are enabled
+func (s *witSink) DeleteGitCommits(namespace string, name string) error {
+	if !s.options.DeleteCommits {
+		return nil
+	}
+	err := s.delete(s.resolve("/api/userspace/git/commits", namespace, "buildConfig", name))
+	if err != nil || !s.options.PublishRewrites {
+		return err
+	}
+	return s.delete(s.resolve("/api/userspace/git/rewrites", namespace, "buildConfig", name))
+}
+
+func (s *witSink) buildConfigURL(namespace string, name string) string {
+	return s.resolve("/api/userspace/kubernetes", namespace, "buildconfigs", name)
+}
@@ -0,0 +1,180 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	k8sclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	maxConflictRetries = 5
+)
+
+// configMapsClient is the part of the ConfigMaps client of a namespace used by the store
+type configMapsClient interface {
+	Get(name string) (*kapi.ConfigMap, error)
+	Create(cm *kapi.ConfigMap) (*kapi.ConfigMap, error)
+	Update(cm *kapi.ConfigMap) (*kapi.ConfigMap, error)
+}
+
+// configMapStore stores all the Cursors as JSON entries in a single ConfigMap
+// with keys of the form {namespace}.{name}
+type configMapStore struct {
+	configMaps configMapsClient
+	namespace  string
+	name       string
+
+	// lock avoids conflicting updates to the ConfigMap from the same process
+	lock sync.Mutex
+}
+
+// NewConfigMapStore returns a StateStore which stores the cursors in the given ConfigMap
+func NewConfigMapStore(c *k8sclient.Client, namespace string, name string) StateStore {
+	return &configMapStore{
+		configMaps: c.ConfigMaps(namespace),
+		namespace:  namespace,
+		name:       name,
+	}
+}
+
+// configMapKey returns the key in the ConfigMap; namespaces cannot contain a '.'
+// so the key is unique
+func configMapKey(namespace string, name string) string {
+	return namespace + "." + name
+}
+
+func (s *configMapStore) get() (*kapi.ConfigMap, error) {
+	cm, err := s.configMaps.Get(s.name)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to load ConfigMap %s in namespace %s due to: %v", s.name, s.namespace, err)
+	}
+	return cm, nil
+}
+
+func (s *configMapStore) Load(namespace string, name string) (*Cursor, error) {
+	cm, err := s.get()
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	key := configMapKey(namespace, name)
+	text := cm.Data[key]
+	if len(text) == 0 {
+		return nil, nil
+	}
+	cursor := Cursor{}
+	err = json.Unmarshal([]byte(text), &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse key %s of ConfigMap %s due to: %v", key, s.name, err)
+	}
+	return &cursor, nil
+}
+
+func (s *configMapStore) Save(cursor *Cursor) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal Cursor to JSON: %v", err)
+	}
+	key := configMapKey(cursor.Namespace, cursor.BuildConfigName)
+	return s.modify(func(cm *kapi.ConfigMap) bool {
+		if cm.Data[key] == string(data) {
+			return false
+		}
+		cm.Data[key] = string(data)
+		return true
+	})
+}
+
+func (s *configMapStore) Delete(namespace string, name string) error {
+	key := configMapKey(namespace, name)
+	return s.modify(func(cm *kapi.ConfigMap) bool {
+		if _, ok := cm.Data[key]; !ok {
+			return false
+		}
+		delete(cm.Data, key)
+		return true
+	})
+}
+
+func (s *configMapStore) List() ([]*Cursor, error) {
+	cm, err := s.get()
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	answer := []*Cursor{}
+	for key, text := range cm.Data {
+		cursor := Cursor{}
+		err = json.Unmarshal([]byte(text), &cursor)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse key %s of ConfigMap %s due to: %v", key, s.name, err)
+		}
+		answer = append(answer, &cursor)
+	}
+	return answer, nil
+}
+
+// modify applies the function to the ConfigMap, creating it if it does not exist,
+// and retrying if the update conflicts with another update
+func (s *configMapStore) modify(fn func(cm *kapi.ConfigMap) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		var cm *kapi.ConfigMap
+		cm, err = s.get()
+		if err != nil {
+			return err
+		}
+		create := cm == nil
+		if create {
+			cm = &kapi.ConfigMap{
+				ObjectMeta: kapi.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+			}
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if !fn(cm) {
+			return nil
+		}
+		if create {
+			_, err = s.configMaps.Create(cm)
+			if err == nil || !kerrors.IsAlreadyExists(err) {
+				break
+			}
+		} else {
+			_, err = s.configMaps.Update(cm)
+			if err == nil || !kerrors.IsConflict(err) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to update ConfigMap %s in namespace %s due to: %v", s.name, s.namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package state
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+)
+
+// fakeConfigMaps stores a single ConfigMap. Another process can create it or
+// update it before each of the given number of updates so that they conflict
+type fakeConfigMaps struct {
+	cm        *kapi.ConfigMap
+	getErr    error
+	conflicts int
+	// other is the cursor saved by another process when an update conflicts
+	other *Cursor
+	// created is the ConfigMap created by another process before the first create
+	created *kapi.ConfigMap
+	creates int
+	updates int
+}
+
+func copyConfigMap(cm *kapi.ConfigMap) *kapi.ConfigMap {
+	answer := *cm
+	answer.Data = map[string]string{}
+	for k, v := range cm.Data {
+		answer.Data[k] = v
+	}
+	return &answer
+}
+
+func (f *fakeConfigMaps) Get(name string) (*kapi.ConfigMap, error) {
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	if f.cm == nil {
+		return nil, kerrors.NewNotFound(kapi.Resource("configmaps"), name)
+	}
+	return copyConfigMap(f.cm), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *kapi.ConfigMap) (*kapi.ConfigMap, error) {
+	f.creates++
+	if f.created != nil {
+		f.cm = f.created
+		f.created = nil
+	}
+	if f.cm != nil {
+		return nil, kerrors.NewAlreadyExists(kapi.Resource("configmaps"), cm.Name)
+	}
+	f.cm = copyConfigMap(cm)
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) Update(cm *kapi.ConfigMap) (*kapi.ConfigMap, error) {
+	f.updates++
+	if f.conflicts > 0 {
+		f.conflicts--
+		if f.other != nil {
+			f.cm.Data[configMapKey(f.other.Namespace, f.other.BuildConfigName)] = fmt.Sprintf(`{"namespace": %q, "buildConfigName": %q}`, f.other.Namespace, f.other.BuildConfigName)
+		}
+		return nil, kerrors.NewConflict(kapi.Resource("configmaps"), cm.Name, fmt.Errorf("the object has been modified"))
+	}
+	f.cm = copyConfigMap(cm)
+	return cm, nil
+}
+
+func newTestConfigMapStore(configMaps *fakeConfigMaps) StateStore {
+	return &configMapStore{
+		configMaps: configMaps,
+		namespace:  "gitcollector",
+		name:       "gitcollector-state",
+	}
+}
+
+func TestConfigMapStore(t *testing.T) {
+	configMaps := &fakeConfigMaps{}
+	store := newTestConfigMapStore(configMaps)
+
+	cursor, err := store.Load("myproject", "a")
+	assert.NoError(t, err)
+	assert.Nil(t, cursor, "there should be no cursor before the ConfigMap is created")
+	cursors, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, cursors)
+	assert.NoError(t, store.Delete("myproject", "a"))
+	assert.Nil(t, configMaps.cm, "deleting a missing cursor should not create the ConfigMap")
+
+	a := testCursor("myproject", "a", "1111")
+	b := testCursor("other", "b", "2222", "3333")
+	assert.NoError(t, store.Save(a))
+	assert.Equal(t, 1, configMaps.creates)
+	if assert.NotNil(t, configMaps.cm) {
+		assert.Equal(t, "gitcollector-state", configMaps.cm.Name)
+		assert.Equal(t, "gitcollector", configMaps.cm.Namespace)
+	}
+	assert.NoError(t, store.Save(b))
+	assert.Equal(t, 1, configMaps.updates)
+	assert.NoError(t, store.Save(testCursor("myproject", "a", "1111")))
+	assert.Equal(t, 1, configMaps.updates, "saving an unchanged cursor should not update the ConfigMap")
+
+	cursor, err = store.Load("other", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, b, cursor)
+	cursors, err = store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Cursor{a, b}, sortCursors(cursors))
+
+	assert.NoError(t, store.Delete("myproject", "a"))
+	cursor, err = store.Load("myproject", "a")
+	assert.NoError(t, err)
+	assert.Nil(t, cursor)
+	assert.Equal(t, []string{"other.b"}, configMapKeys(configMaps.cm))
+}
+
+func TestConfigMapStoreRetriesConflicts(t *testing.T) {
+	other := &Cursor{Namespace: "other", BuildConfigName: "c"}
+	tests := []struct {
+		name      string
+		conflicts int
+		fails     bool
+		updates   int
+	}{
+		{name: "no conflict", conflicts: 0, updates: 1},
+		{name: "one conflict", conflicts: 1, updates: 2},
+		{name: "conflicts until the last retry", conflicts: maxConflictRetries - 1, updates: maxConflictRetries},
+		{name: "too many conflicts", conflicts: maxConflictRetries, fails: true, updates: maxConflictRetries},
+	}
+	for _, test := range tests {
+		configMaps := &fakeConfigMaps{}
+		store := newTestConfigMapStore(configMaps)
+		assert.NoError(t, store.Save(testCursor("myproject", "a", "1111")))
+		configMaps.conflicts = test.conflicts
+		configMaps.other = other
+		err := store.Save(testCursor("myproject", "b", "2222"))
+		assert.Equal(t, test.updates, configMaps.updates, "%s: updates", test.name)
+		if test.fails {
+			assert.Error(t, err, test.name)
+			continue
+		}
+		assert.NoError(t, err, test.name)
+		expected := []string{"myproject.a", "myproject.b"}
+		if test.conflicts > 0 {
+			// the update made by the other process is kept
+			expected = append(expected, "other.c")
+		}
+		assert.Equal(t, expected, configMapKeys(configMaps.cm), test.name)
+	}
+}
+
+func TestConfigMapStoreCreateConflict(t *testing.T) {
+	configMaps := &fakeConfigMaps{
+		created: &kapi.ConfigMap{Data: map[string]string{"other.c": "{}"}},
+	}
+	store := newTestConfigMapStore(configMaps)
+	assert.NoError(t, store.Save(testCursor("myproject", "a", "1111")))
+	assert.Equal(t, 1, configMaps.creates)
+	assert.Equal(t, 1, configMaps.updates)
+	assert.Equal(t, []string{"myproject.a", "other.c"}, configMapKeys(configMaps.cm))
+}
+
+func TestConfigMapStoreErrors(t *testing.T) {
+	configMaps := &fakeConfigMaps{getErr: fmt.Errorf("connection refused")}
+	store := newTestConfigMapStore(configMaps)
+	_, err := store.Load("myproject", "a")
+	assert.Error(t, err, "a ConfigMap which can't be read is an error rather than a first run")
+	_, err = store.List()
+	assert.Error(t, err)
+	assert.Error(t, store.Save(testCursor("myproject", "a", "1111")))
+
+	configMaps = &fakeConfigMaps{cm: &kapi.ConfigMap{Data: map[string]string{"myproject.a": "{\"heads\": "}}}
+	store = newTestConfigMapStore(configMaps)
+	_, err = store.Load("myproject", "a")
+	assert.Error(t, err)
+}
+
+// configMapKeys returns the sorted keys of the ConfigMap
+func configMapKeys(cm *kapi.ConfigMap) []string {
+	answer := []string{}
+	for key := range cm.Data {
+		answer = append(answer, key)
+	}
+	sort.Strings(answer)
+	return answer
+}
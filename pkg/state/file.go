@@ -0,0 +1,126 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileStore stores each Cursor as a JSON file at {dir}/{namespace}/{name}.json
+type fileStore struct {
+	dir string
+}
+
+// NewFileStore returns a StateStore which stores JSON files in the given directory
+func NewFileStore(dir string) (StateStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create state directory %s due to: %v", dir, err)
+	}
+	return &fileStore{
+		dir: dir,
+	}, nil
+}
+
+func (s *fileStore) fileName(namespace string, name string) string {
+	return filepath.Join(s.dir, namespace, name+".json")
+}
+
+func (s *fileStore) Load(namespace string, name string) (*Cursor, error) {
+	fileName := s.fileName(namespace, name)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to read state file %s due to: %v", fileName, err)
+	}
+	cursor := Cursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s due to: %v", fileName, err)
+	}
+	return &cursor, nil
+}
+
+func (s *fileStore) Save(cursor *Cursor) error {
+	fileName := s.fileName(cursor.Namespace, cursor.BuildConfigName)
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal Cursor to JSON: %v", err)
+	}
+	err = os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return fmt.Errorf("Unable to create state directory for %s due to: %v", fileName, err)
+	}
+	// lets write to a temporary file then rename so we never leave a partially written file
+	tmpFile := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write state file %s due to: %v", tmpFile, err)
+	}
+	err = os.Rename(tmpFile, fileName)
+	if err != nil {
+		return fmt.Errorf("Failed to rename state file %s due to: %v", tmpFile, err)
+	}
+	return nil
+}
+
+func (s *fileStore) Delete(namespace string, name string) error {
+	fileName := s.fileName(namespace, name)
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove state file %s due to: %v", fileName, err)
+	}
+	return nil
+}
+
+func (s *fileStore) List() ([]*Cursor, error) {
+	namespaceDirs, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state directory %s due to: %v", s.dir, err)
+	}
+	answer := []*Cursor{}
+	for _, namespaceDir := range namespaceDirs {
+		if !namespaceDir.IsDir() {
+			continue
+		}
+		namespace := namespaceDir.Name()
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, namespace))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read state directory %s due to: %v", namespace, err)
+		}
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			cursor, err := s.Load(namespace, strings.TrimSuffix(name, ".json"))
+			if err != nil {
+				return nil, err
+			}
+			if cursor != nil {
+				answer = append(answer, cursor)
+			}
+		}
+	}
+	return answer, nil
+}
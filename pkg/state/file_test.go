@@ -0,0 +1,106 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCursor(namespace string, name string, heads ...string) *Cursor {
+	return &Cursor{
+		Namespace:       namespace,
+		BuildConfigName: name,
+		URI:             "https://github.com/fabric8io/" + name + ".git",
+		Ref:             "master",
+		Heads:           heads,
+		Tip:             heads[len(heads)-1],
+	}
+}
+
+// sortCursors sorts the cursors by their namespace and name
+func sortCursors(cursors []*Cursor) []*Cursor {
+	sort.Sort(byKey(cursors))
+	return cursors
+}
+
+type byKey []*Cursor
+
+func (c byKey) Len() int      { return len(c) }
+func (c byKey) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byKey) Less(i, j int) bool {
+	return c[i].Namespace+"/"+c[i].BuildConfigName < c[j].Namespace+"/"+c[j].BuildConfigName
+}
+
+func TestFileStore(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "gitcollector-state-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+	dir := filepath.Join(workDir, ".state")
+	store, err := NewFileStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cursor, err := store.Load("myproject", "a")
+	assert.NoError(t, err)
+	assert.Nil(t, cursor, "there should be no cursor before one is saved")
+	cursors, err := store.List()
+	assert.NoError(t, err)
+	assert.Empty(t, cursors)
+
+	a := testCursor("myproject", "a", "1111")
+	b := testCursor("myproject", "b", "2222", "3333")
+	c := testCursor("other", "c", "4444")
+	for _, cursor := range []*Cursor{a, b, c} {
+		assert.NoError(t, store.Save(cursor))
+	}
+	a = testCursor("myproject", "a", "5555")
+	assert.NoError(t, store.Save(a))
+	cursor, err = store.Load("myproject", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, a, cursor)
+
+	// files which are not cursors are ignored
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "myproject", "d.json.tmp"), []byte("{"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("cursors"), 0600))
+	cursors, err = store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Cursor{a, b, c}, sortCursors(cursors))
+
+	assert.NoError(t, store.Delete("myproject", "b"))
+	assert.NoError(t, store.Delete("myproject", "b"), "deleting a missing cursor should succeed")
+	cursor, err = store.Load("myproject", "b")
+	assert.NoError(t, err)
+	assert.Nil(t, cursor)
+	cursors, err = store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Cursor{a, c}, sortCursors(cursors))
+
+	// a cursor which can't be parsed is an error rather than a first run
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other", "c.json"), []byte("{\"heads\": "), 0600))
+	_, err = store.Load("other", "c")
+	assert.Error(t, err)
+	_, err = store.List()
+	assert.Error(t, err)
+}
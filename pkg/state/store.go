@@ -0,0 +1,69 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package state
+
+// Cursor is the position a BuildConfig has reached in its git history so that
+// collection can resume where it left off after a restart
+type Cursor struct {
+	Namespace       string `json:"namespace,omitempty"`
+	BuildConfigName string `json:"buildConfigName,omitempty"`
+	URI             string `json:"uri,omitempty"`
+	Ref             string `json:"ref,omitempty"`
+	// Heads are the commits whose history has been published
+	Heads []string `json:"heads,omitempty"`
+
+	// Tip is the last tip of the ref which was seen
+	Tip string `json:"tip,omitempty"`
+}
+
+// StateStore persists the Cursor of each BuildConfig
+type StateStore interface {
+	// Load returns the cursor for the BuildConfig or nil if there is none
+	Load(namespace string, name string) (*Cursor, error)
+
+	// Save stores the cursor
+	Save(cursor *Cursor) error
+
+	// Delete removes any cursor for the BuildConfig
+	Delete(namespace string, name string) error
+
+	// List returns all the stored cursors
+	List() ([]*Cursor, error)
+}
+
+// noopStore is used when state should not be persisted
+type noopStore struct{}
+
+// NewNoopStore returns a StateStore which does not persist anything
+func NewNoopStore() StateStore {
+	return &noopStore{}
+}
+
+func (s *noopStore) Load(namespace string, name string) (*Cursor, error) {
+	return nil, nil
+}
+
+func (s *noopStore) Save(cursor *Cursor) error {
+	return nil
+}
+
+func (s *noopStore) Delete(namespace string, name string) error {
+	return nil
+}
+
+func (s *noopStore) List() ([]*Cursor, error) {
+	return nil, nil
+}
@@ -0,0 +1,204 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/fabric8io/gitcollector/pkg/util"
+	oclient "github.com/openshift/origin/pkg/client"
+	k8sclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const (
+	defaultBackfillCommits = 10
+	defaultBatchSize       = 10
+
+	backfillAll = "all"
+)
+
+// Backfill is how much of the existing history of a BuildConfig is published the first time
+// it is collected; either all of it, the latest Commits commits or the commits since a time
+type Backfill struct {
+	All     bool
+	Commits int
+	Since   time.Time
+}
+
+// ParseBackfill parses a backfill which is either "all", a number of commits
+// or a date such as 2017-01-31 or an RFC3339 time
+func ParseBackfill(text string) (Backfill, error) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return Backfill{}, nil
+	}
+	if strings.ToLower(text) == backfillAll {
+		return Backfill{All: true}, nil
+	}
+	if commits, err := strconv.Atoi(text); err == nil {
+		if commits <= 0 {
+			return Backfill{}, fmt.Errorf("Invalid backfill %s as the number of commits must be positive", text)
+		}
+		return Backfill{Commits: commits}, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if since, err := time.Parse(layout, text); err == nil {
+			return Backfill{Since: since}, nil
+		}
+	}
+	return Backfill{}, fmt.Errorf("Invalid backfill %s. Use %s, a number of commits or a date such as 2017-01-31", text, backfillAll)
+}
+
+// IsZero returns true if no backfill has been configured
+func (h Backfill) IsZero() bool {
+	return !h.All && h.Commits <= 0 && h.Since.IsZero()
+}
+
+func (h Backfill) String() string {
+	switch {
+	case h.All || h.IsZero():
+		return "all commits"
+	case !h.Since.IsZero():
+		return "the commits since " + h.Since.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("the latest %d commits", h.Commits)
+	}
+}
+
+// withDefaults returns the backfill or the default of the latest 10 commits if there is none
+func (h Backfill) withDefaults() Backfill {
+	if h.IsZero() {
+		h.Commits = defaultBackfillCommits
+	}
+	return h
+}
+
+// revListOptions returns the options to list the history to backfill
+func (h Backfill) revListOptions() gitbackend.RevListOptions {
+	if h.All {
+		return gitbackend.RevListOptions{}
+	}
+	return gitbackend.RevListOptions{
+		Limit: h.Commits,
+		Since: h.Since,
+	}
+}
+
+// BackfillOptions is the history of a BuildConfig to republish on demand
+type BackfillOptions struct {
+	Namespace   string
+	BuildConfig string
+	Backfill    Backfill
+	// From is the commit to republish the history after; its history is not republished
+	From string
+	// To is the commit or ref to republish the history up to which defaults to the ref of the BuildConfig
+	To string
+}
+
+// RunBackfill republishes the history of a BuildConfig in the given range returning the number
+// of commits published. Its git repository is cloned into a temporary directory in the work directory
+// which is removed afterwards, and the cursor of the BuildConfig used by the operator is not changed
+func RunBackfill(ctx context.Context, c *k8sclient.Client, oc *oclient.Client, flags *WatchFlags, options *BackfillOptions) (int, error) {
+	backfillFlags := *flags
+	backfillFlags.StateStore = stateStoreNone
+	b := newWatcher(c, oc, &backfillFlags, false)
+
+	ns := options.Namespace
+	name := options.BuildConfig
+	key := collectorKey(ns, name)
+	bc, err := oc.BuildConfigs(ns).Get(name)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to find BuildConfig %s due to %v", key, err)
+	}
+	gs := b.GitSource(bc)
+	if gs == nil || len(gs.URI) == 0 {
+		return 0, fmt.Errorf("BuildConfig %s does not have a git source", key)
+	}
+	source, err := b.backendSource(bc, gs)
+	if err != nil {
+		return 0, err
+	}
+	timeouts := &b.timeouts
+
+	// lets clone into a private directory rather than the mirrors the operator may be
+	// fetching into at the same time from another process
+	tmpDir, err := ioutil.TempDir(b.workDir, ".backfill-")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create a temporary directory in %s due to %v", b.workDir, err)
+	}
+	defer removeDir(tmpDir)
+	b.mirrors = newMirrors(tmpDir)
+	mr := b.mirrors.acquire(mirrorKey(bc, gs), ns, key)
+	_, err = mr.sync(ctx, b.backend, source, timeouts, 0)
+	// the ref of the BuildConfig is not needed when backfilling up to another commit
+	if err != nil && !(gitbackend.IsRefNotFound(err) && len(options.To) > 0) {
+		return 0, fmt.Errorf("Failed to update the git repository for %s due to %v", key, err)
+	}
+
+	to := options.To
+	if len(to) == 0 {
+		to = gs.Ref
+	}
+	readCtx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+	repo, err := b.backend.Open(readCtx, mr.dir)
+	if err != nil {
+		return 0, err
+	}
+	tip, err := repo.ResolveRef(to)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to resolve %s in %s due to %v", to, gs.URI, err)
+	}
+	exclude := []string{}
+	if len(options.From) > 0 {
+		from, err := repo.ResolveRef(options.From)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to resolve %s in %s due to %v", options.From, gs.URI, err)
+		}
+		exclude = append(exclude, from.Hash)
+	}
+	commits, err := repo.RevList(tip.Hash, exclude, options.Backfill.revListOptions())
+	if err != nil {
+		return 0, err
+	}
+	util.Infof("Republishing %d commits of %s from %s\n", len(commits), key, options.Backfill)
+
+	// lets publish in batches so that the deadline for reading the history applies to each batch
+	contextDir := b.contextDir(bc)
+	count := 0
+	for len(commits) > 0 {
+		batchCtx, cancel := context.WithTimeout(ctx, timeouts.Read)
+		repo, err := b.backend.Open(batchCtx, mr.dir)
+		if err == nil {
+			var processed []*gitbackend.Commit
+			var published int
+			processed, published, err = b.publishCommits(repo, bc, contextDir, commits, b.batchSize())
+			commits = commits[len(processed):]
+			count += published
+		}
+		cancel()
+		if err != nil {
+			return count, fmt.Errorf("Failed to republish the commits of %s due to %v", key, err)
+		}
+	}
+	return count, nil
+}
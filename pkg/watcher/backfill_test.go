@@ -0,0 +1,73 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBackfill(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected Backfill
+		invalid  bool
+	}{
+		{text: "", expected: Backfill{}},
+		{text: "  ", expected: Backfill{}},
+		{text: "all", expected: Backfill{All: true}},
+		{text: "ALL", expected: Backfill{All: true}},
+		{text: "25", expected: Backfill{Commits: 25}},
+		{text: " 25 ", expected: Backfill{Commits: 25}},
+		{text: "0", invalid: true},
+		{text: "-5", invalid: true},
+		{text: "2017-01-31", expected: Backfill{Since: time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)}},
+		{text: "2017-01-31T10:30:00Z", expected: Backfill{Since: time.Date(2017, 1, 31, 10, 30, 0, 0, time.UTC)}},
+		{text: "31/01/2017", invalid: true},
+		{text: "latest", invalid: true},
+	}
+	for _, test := range tests {
+		answer, err := ParseBackfill(test.text)
+		if test.invalid {
+			assert.Error(t, err, test.text)
+			continue
+		}
+		if assert.NoError(t, err, test.text) {
+			assert.Equal(t, test.expected.All, answer.All, test.text)
+			assert.Equal(t, test.expected.Commits, answer.Commits, test.text)
+			assert.True(t, test.expected.Since.Equal(answer.Since), "%s: expected since %v but was %v", test.text, test.expected.Since, answer.Since)
+		}
+	}
+}
+
+func TestBackfillRevListOptions(t *testing.T) {
+	since := time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		backfill Backfill
+		expected gitbackend.RevListOptions
+	}{
+		{Backfill{All: true}, gitbackend.RevListOptions{}},
+		{Backfill{}.withDefaults(), gitbackend.RevListOptions{Limit: defaultBackfillCommits}},
+		{Backfill{Commits: 25}, gitbackend.RevListOptions{Limit: 25}},
+		{Backfill{Since: since}, gitbackend.RevListOptions{Since: since}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.backfill.revListOptions(), test.backfill.String())
+	}
+}
@@ -1,77 +1,255 @@
 package watcher
 
 import (
+	"context"
 	"fmt"
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/fabric8io/gitcollector/pkg/publisher"
+	"github.com/fabric8io/gitcollector/pkg/state"
 	"github.com/fabric8io/gitcollector/pkg/util"
 	"github.com/google/go-github/github"
-	"github.com/src-d/go-git"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"srcd.works/go-git.v4/plumbing"
+	"strings"
+	"sync"
+	"time"
 
 	buildapi "github.com/openshift/origin/pkg/build/api"
-	"io"
 )
 
+type BuildConfigCollector struct {
+	name      string
+	namespace string
+	watcher   *Watcher
+
+	// lock guards the following fields as the collector is processed by a worker
+	// while the watch updates or deletes its BuildConfig
+	lock          sync.Mutex
+	buildConfig   buildapi.BuildConfig
+	busy          bool
+	deletePending bool
+	unpublish     unpublishMode
+	mirror        *mirror
+	nextDue       time.Time
+	pollInterval  time.Duration
+	failures      int
+	lastBuild     time.Time
+	// fetchRequested is set when a build or a git source change makes a poll due so that it
+	// fetches the mirror rather than reading the mirror another BuildConfig fetched recently
+	fetchRequested bool
+
+	// the cursor is only accessed by the worker processing the collector
+	// heads are the commits whose history has been published and tip
+	// is the last tip of the ref we have seen
+	cursorLoaded bool
+	heads        []string
+	tip          string
+}
+
+// key returns the unique key of the BuildConfig across namespaces
+func (w *BuildConfigCollector) key() string {
+	return collectorKey(w.namespace, w.name)
+}
+
+// BuildConfig returns a copy of the current BuildConfig
+func (w *BuildConfigCollector) BuildConfig() buildapi.BuildConfig {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buildConfig
+}
+
+// update replaces the BuildConfig returning the previous one
+func (w *BuildConfigCollector) update(bc *buildapi.BuildConfig) buildapi.BuildConfig {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	old := w.buildConfig
+	w.buildConfig = *bc
+	return old
+}
+
+// unpublishMode is what is removed from the sinks when a collector is deleted
+type unpublishMode int
+
 const (
-	maxCommits = 10
+	unpublishNone unpublishMode = iota
+	// unpublishCommits removes the commits such as when the git source changes
+	unpublishCommits
+	// unpublishBuildConfig removes the BuildConfig and its commits when it is deleted
+	unpublishBuildConfig
 )
 
-type BuildConfigCollector struct {
-	name        string
-	workDir     string
-	watcher     *Watcher
-	buildConfig buildapi.BuildConfig
+// acquire marks the collector as busy returning false if a worker is already processing it
+func (w *BuildConfigCollector) acquire() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.busy {
+		return false
+	}
+	w.busy = true
+	return true
+}
 
-	firstGitHash string
-	lastGitHash  string
+// release marks the collector as no longer busy, releasing its mirror and removing
+// its cursor if it was deleted while being processed
+func (w *BuildConfigCollector) release() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.busy = false
+	if w.deletePending {
+		w.deletePending = false
+		w.delete()
+	}
 }
 
-// Delete removes the work directory for the given watch
-func (w *BuildConfigCollector) Delete() {
-	name := w.buildConfig.Name
-	workDir := w.workDir
-	if fileNotExist(workDir) {
+// Delete releases the mirror and removes the cursor for the given watch along with removing
+// what was published to the sinks for the given mode; if a worker is currently processing
+// the collector they are removed when the worker is done so that the removal is published
+// after any commits the worker publishes
+func (w *BuildConfigCollector) Delete(mode unpublishMode) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if mode > w.unpublish {
+		w.unpublish = mode
+	}
+	if w.busy {
+		w.deletePending = true
 		return
 	}
-	err := os.RemoveAll(workDir)
+	w.delete()
+}
+
+// delete removes the mirror, cursor and published data; the lock must be held
+func (w *BuildConfigCollector) delete() {
+	w.releaseMirror()
+	w.deleteCursor()
+	w.watcher.unpublish(w.namespace, w.name, w.unpublish)
+	w.unpublish = unpublishNone
+}
+
+// useMirror returns the mirror with the given key, releasing any other mirror
+// the collector was using such as before its git source changed
+func (w *BuildConfigCollector) useMirror(key string) *mirror {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.mirror != nil && w.mirror.key == key {
+		return w.mirror
+	}
+	w.releaseMirror()
+	w.mirror = w.watcher.mirrors.acquire(key, w.namespace, w.key())
+	return w.mirror
+}
+
+// releaseMirror stops using the mirror which is removed if no other collector
+// is using it; the lock must be held
+func (w *BuildConfigCollector) releaseMirror() {
+	if w.mirror != nil {
+		w.watcher.mirrors.release(w.mirror, w.key())
+		w.mirror = nil
+	}
+}
+
+// loadCursor loads the cursor from the state store the first time the collector is processed
+// ignoring any cursor for a different git source. Only a missing cursor is a first run; if the
+// cursor can't be loaded an error is returned so that the history is not published again
+func (w *BuildConfigCollector) loadCursor(gs *buildapi.GitBuildSource) error {
+	if w.cursorLoaded {
+		return nil
+	}
+	cursor, err := w.watcher.stateStore.Load(w.namespace, w.name)
 	if err != nil {
-		util.Warnf("Failed to remove workDir %s for BuildConfig %s due to: %v\n", workDir, name, err)
-	} else {
-		util.Infof("Just deleted the folder %s for BuildConfig %s\n", workDir, name)
+		return fmt.Errorf("Failed to load the cursor for %s due to %v", w.key(), err)
+	}
+	w.cursorLoaded = true
+	if cursor != nil && cursor.URI == gs.URI && cursor.Ref == gs.Ref {
+		util.Infof("Resuming %s from commits %v\n", w.key(), cursor.Heads)
+		w.heads = cursor.Heads
+		w.tip = cursor.Tip
+	}
+	return nil
+}
+
+// saveCursor stores the current cursor in the state store
+func (w *BuildConfigCollector) saveCursor(gs *buildapi.GitBuildSource) error {
+	cursor := state.Cursor{
+		Namespace:       w.namespace,
+		BuildConfigName: w.name,
+		URI:             gs.URI,
+		Ref:             gs.Ref,
+		Heads:           w.heads,
+		Tip:             w.tip,
 	}
+	return w.watcher.stateStore.Save(&cursor)
 }
 
-func (w *BuildConfigCollector) Process() int {
-	bc := &w.buildConfig
+// deleteCursor resets the cursor and removes it from the state store
+func (w *BuildConfigCollector) deleteCursor() {
+	w.cursorLoaded = false
+	w.heads = nil
+	w.tip = ""
+	err := w.watcher.stateStore.Delete(w.namespace, w.name)
+	if err != nil {
+		util.Warnf("Failed to delete the cursor for %s due to %v\n", w.key(), err)
+	}
+}
+
+// Process clones or fetches the shared mirror of the git repository then publishes
+// any new commits, returning the number of commits published. Each git operation has
+// its own deadline and is cancelled if the context is cancelled
+func (w *BuildConfigCollector) Process(ctx context.Context) (int, error) {
+	buildConfig := w.BuildConfig()
+	bc := &buildConfig
 	gs := w.watcher.GitSource(bc)
-	if gs == nil {
-		return 0
+	if gs == nil || len(gs.URI) == 0 {
+		return 0, nil
 	}
 	name := bc.Name
-	workDir := w.workDir
-	gitDir := filepath.Join(workDir, ".git")
-	if stat, err := os.Stat(gitDir); err != nil || !stat.IsDir() {
-		err := w.cloneRepo(gs)
-		if err != nil {
-			util.Warnf("Failed to clone repo for %s due to %v\n", name, err)
-		}
-	} else {
-		err := w.pullRepo(gs)
-		if err != nil {
-			util.Warnf("Failed to pull repo for %s due to %v\n", name, err)
+	source, err := w.watcher.backendSource(bc, gs)
+	if err != nil {
+		return 0, err
+	}
+	timeouts := &w.watcher.timeouts
+
+	// BuildConfigs sharing a mirror only need to fetch it once per poll interval
+	// unless a build or a git source change requested this poll
+	maxAge := w.watcher.schedule.PollInterval
+	fetch := w.takeFetchRequest()
+	if fetch {
+		maxAge = 0
+	}
+	mr := w.useMirror(mirrorKey(bc, gs))
+	w.watcher.mirrors.use(mr)
+	defer w.watcher.mirrors.done(mr)
+	changed, gitErr := mr.sync(ctx, w.watcher.backend, source, timeouts, maxAge)
+	if w.watcher.flags.DiskQuota.enabled() {
+		w.watcher.mirrors.measure(mr, changed)
+	}
+	if gitErr != nil {
+		if fetch {
+			w.requestFetch()
 		}
+		gitErr = fmt.Errorf("Failed to update the git repository for %s due to %v", name, gitErr)
 	}
 
-	count, err := w.processCommit()
+	err = w.loadCursor(gs)
 	if err != nil {
-		util.Warnf("Failed to process commit for %s due to %v\n", name, err)
-		return 0
+		return 0, err
+	}
+	heads := w.heads
+	tip := w.tip
+	readCtx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	count, err := w.processCommit(readCtx, mr.dir, bc, gs)
+	cancel()
+	if !equalStrings(heads, w.heads) || tip != w.tip {
+		saveErr := w.saveCursor(gs)
+		if saveErr != nil {
+			util.Warnf("Failed to save the cursor for %s due to %v\n", w.key(), saveErr)
+		}
+	}
+	if err != nil {
+		return count, fmt.Errorf("Failed to process commit for %s due to %v", name, err)
 	}
 
 	if useGithub {
-		client := github.NewClient(nil)
+		client := github.NewClient(source.Proxy.HTTPClient())
 		repo, _, err := client.Repositories.Get("fabric8io", "gitcontroller")
 		if err != nil {
 			util.Warnf("Failed to find repo for gitcontroller! %v\n", err)
@@ -83,150 +261,177 @@ func (w *BuildConfigCollector) Process() int {
 			}
 		}
 	}
-	return count
+	return count, gitErr
 }
 
-func (w *BuildConfigCollector) processCommit() (int, error) {
-	repo, err := git.PlainOpen(w.workDir)
+// processCommit publishes the commits on the configured ref which have not yet been
+// published, oldest first, advancing the heads as each commit is processed.
+// Commits which don't change any files in the ContextDir of the BuildConfig are skipped.
+// If the history of the ref has been rewritten a history rewritten event is published
+// first. On the first run only the configured backfill of the history is published and
+// each run publishes at most the batch size of commits
+func (w *BuildConfigCollector) processCommit(ctx context.Context, dir string, bc *buildapi.BuildConfig, gs *buildapi.GitBuildSource) (int, error) {
+	repo, err := w.watcher.backend.Open(ctx, dir)
 	if err != nil {
 		return 0, err
 	}
-	iter, err := repo.Commits()
+	tip, err := repo.ResolveRef(gs.Ref)
 	if err != nil {
 		return 0, err
 	}
-	count := 0
-	process := true
-	first := true
-	oldestHashLastRun := w.lastGitHash
-	defer iter.Close()
-	for {
-		commit, err := iter.Next()
+	tipHash := tip.Hash
+	if len(w.tip) > 0 && w.tip != tipHash && isRewrite(repo, w.tip, tipHash) {
+		util.Warnf("The history of %s ref %s has been rewritten from %s to %s\n", w.key(), gs.Ref, w.tip, tipHash)
+		err = w.watcher.publisher.UpsertHistoryRewritten(publisher.NewHistoryRewritten(bc, gs.Ref, w.tip, tipHash))
 		if err != nil {
-			if err == io.EOF {
-				break
+			if !publisher.IsPermanent(err) {
+				return 0, err
 			}
-			return 0, err
+			util.Errorf("Skipping the history rewritten event of %s as publishing it failed permanently due to %v\n", w.key(), err)
 		}
-		if commit == nil {
-			break
+	}
+	w.tip = tipHash
+	if len(w.heads) == 1 && w.heads[0] == tipHash {
+		return 0, nil
+	}
+
+	// any previously published heads which are no longer in the repository can't be
+	// excluded so we treat that like a first run
+	exclude := []string{}
+	for _, hash := range w.heads {
+		if repo.HasCommit(hash) {
+			exclude = append(exclude, hash)
 		}
+	}
+	firstRun := len(exclude) == 0
+	options := gitbackend.RevListOptions{}
+	if firstRun {
+		options = w.watcher.backfill.revListOptions()
+		util.Infof("Backfilling %s with %s\n", w.key(), w.watcher.backfill)
+	}
+	commits, err := repo.RevList(tipHash, exclude, options)
+	if err != nil {
+		return 0, err
+	}
+	contextDir := w.watcher.contextDir(bc)
+	processed, count, err := w.watcher.publishCommits(repo, bc, contextDir, commits, w.watcher.batchSize())
+	if len(processed) == len(commits) {
+		w.heads = []string{tipHash}
+	} else if firstRun {
+		// the history before the backfill is treated as already published so that
+		// the rest of the backfill is published by the following runs
+		w.heads = advanceHeads(boundaryParents(commits), processed)
+	} else {
+		w.heads = advanceHeads(w.heads, processed)
+	}
+	return count, err
+}
 
-		hash := commit.Hash.String()
-		if first {
-			first = false
-			if hash == w.firstGitHash {
-				// are we starting off with the same first hash as last time in which case
-				// lets wait until after we find the last hash before processing again
-				process = false
-			} else if len(w.firstGitHash) == 0 {
-				w.firstGitHash = hash
-			}
+// isRewrite returns true if the old tip is no longer reachable from the new tip.
+// An old tip which is missing from a shallow clone, such as when the mirror was cloned
+// again, may just be outside its boundary so it is not treated as a rewrite
+func isRewrite(repo gitbackend.Repository, oldTip string, tip string) bool {
+	if !repo.HasCommit(oldTip) {
+		return !repo.IsShallow()
+	}
+	return !repo.IsAncestor(oldTip, tip)
+}
+
+// publishCommits publishes up to limit of the commits as a single batch skipping any commits
+// which don't change files in the context directory. It returns the commits which were processed,
+// which is none if the batch could not be published, and the number of commits published.
+// A batch which fails permanently is logged and skipped as retrying it would fail the same way
+func (b *Watcher) publishCommits(repo gitbackend.Repository, bc *buildapi.BuildConfig, contextDir string, commits []*gitbackend.Commit, limit int) ([]*gitbackend.Commit, int, error) {
+	processed := []*gitbackend.Commit{}
+	batch := []*publisher.BuildConfigCommit{}
+	var err error
+	for _, commit := range commits {
+		if len(batch) >= limit {
+			break
 		}
-		if process {
-			util.Infof("Name %s commit %s : %s\n", w.name, commit.Hash, commit.Message)
-			err = w.watcher.publisher.UpsertGitCommit(&w.buildConfig, commit)
+		var paths []string
+		if len(contextDir) > 0 {
+			var changed []string
+			changed, err = repo.Diff(commit)
 			if err != nil {
-				return count, err
-			}
-			count = count + 1
-			w.lastGitHash = hash
-			if count >= maxCommits {
 				break
 			}
+			paths = filterPaths(changed, contextDir)
+			if len(paths) == 0 {
+				processed = append(processed, commit)
+				continue
+			}
 		}
-		if oldestHashLastRun == hash {
-			// we've now passed all the previously processed commits
-			process = true
-		}
+		util.Infof("Name %s commit %s : %s\n", collectorKey(bc.Namespace, bc.Name), commit.Hash, commit.Message)
+		batch = append(batch, publisher.NewBuildConfigCommit(bc, commit, paths))
+		processed = append(processed, commit)
 	}
-	return count, nil
-}
-
-func (w *BuildConfigCollector) pullRepo(gs *buildapi.GitBuildSource) error {
-	util.Infof("git pull on %s\n", w.name)
-	binaryFile := resolveBinaryLocation("git")
-	args := []string{"pull"}
-	e := exec.Command(binaryFile, args...)
-	e.Dir = w.watcher.workDir
-	e.Stdout = os.Stdout
-	e.Stderr = os.Stderr
-	err := e.Run()
-	if err != nil {
-		util.Errorf("Unable to start git pull %v\n", err)
-		return err
+	pubErr := b.publisher.UpsertGitCommits(batch)
+	if pubErr != nil {
+		if !publisher.IsPermanent(pubErr) {
+			return []*gitbackend.Commit{}, 0, pubErr
+		}
+		// sending the same commits again would fail the same way so lets skip them
+		// rather than never moving the cursor past them
+		util.Errorf("Skipping %d commits of %s as publishing them failed permanently due to %v\n", len(batch), collectorKey(bc.Namespace, bc.Name), pubErr)
+		return processed, 0, err
 	}
-	return nil
+	return processed, len(batch), err
 }
 
-func (w *BuildConfigCollector) cloneRepo(gs *buildapi.GitBuildSource) error {
-	// TODO should we check the uri & ref with the .git/config in case we restart and have a PV?
-
-	bc := w.buildConfig
-	name := bc.Name
-
-	uri := gs.URI
-	if len(uri) == 0 {
-		return nil
-	}
-	ref := gs.Ref
-	if len(ref) == 0 {
-		ref = "master"
-	}
-	namespaceDir := filepath.Join(w.watcher.workDir, bc.Namespace)
-	workDir := w.workDir
-	err := os.MkdirAll(namespaceDir, 0700)
-	if err != nil {
-		return fmt.Errorf("Unable to create namespace work directory %s due to: %v\n", namespaceDir, err)
+// boundaryParents returns the parents of the commits which are not themselves in the commits;
+// which is the history excluded from a bounded rev list
+func boundaryParents(commits []*gitbackend.Commit) []string {
+	listed := map[string]bool{}
+	for _, commit := range commits {
+		listed[commit.Hash] = true
 	}
-	util.Infof("Cloning repo %s ref %s for BuildConfig %s to %s\n", uri, ref, name, workDir)
-	if useGoGit {
-		options := git.CloneOptions{
-			URL:      uri,
-			Progress: os.Stdout,
-		}
-		if len(ref) > 0 {
-			options.ReferenceName = plumbing.ReferenceName(ref)
-		}
-		r, err := git.PlainClone(workDir, false, &options)
-		if err != nil {
-			return err
-		}
-		gitRef, err := r.Head()
-		if err != nil {
-			return fmt.Errorf("Failed to find HEAD: %v", err)
-		}
-		hash := gitRef.Hash()
-		if len(hash) > 0 {
-			commit, err := r.Commit(hash)
-			if err != nil {
-				return fmt.Errorf("Failed to find Commit for %v due to: %v", hash, err)
+	answer := []string{}
+	added := map[string]bool{}
+	for _, commit := range commits {
+		for _, parentHash := range commit.ParentHashes {
+			if !listed[parentHash] && !added[parentHash] {
+				added[parentHash] = true
+				answer = append(answer, parentHash)
 			}
-			fmt.Printf("found latest commit %s\n", commit)
 		}
-		return err
 	}
-	binaryFile := resolveBinaryLocation("git")
-	args := []string{"clone", uri, name}
-	e := exec.Command(binaryFile, args...)
-	e.Dir = namespaceDir
-	e.Stdout = os.Stdout
-	e.Stderr = os.Stderr
-	err = e.Run()
-	if err != nil {
-		util.Errorf("Unable to start git clone %v\n", err)
-		return err
+	return answer
+}
+
+// filterPaths returns the paths which are inside the directory
+func filterPaths(paths []string, dir string) []string {
+	answer := []string{}
+	for _, p := range paths {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			answer = append(answer, p)
+		}
 	}
-	return nil
+	return answer
 }
 
-// lets find the executable on the PATH or in the fabric8 directory
-func resolveBinaryLocation(executable string) string {
-	path, err := exec.LookPath(executable)
-	if err != nil || fileNotExist(path) {
-		return executable
+// advanceHeads returns the heads of the history which has been processed given the previous
+// heads and the newly processed commits in topological order; so that the commits still to be
+// processed are exactly those reachable from the tip but not from the returned heads
+func advanceHeads(previous []string, published []*gitbackend.Commit) []string {
+	parents := map[string]bool{}
+	for _, commit := range published {
+		for _, parentHash := range commit.ParentHashes {
+			parents[parentHash] = true
+		}
+	}
+	answer := []string{}
+	for _, hash := range previous {
+		if !parents[hash] {
+			answer = append(answer, hash)
+		}
 	}
-	return path
+	for _, commit := range published {
+		if !parents[commit.Hash] {
+			answer = append(answer, commit.Hash)
+		}
+	}
+	return answer
 }
 
 func findExecutable(file string) error {
@@ -243,3 +448,15 @@ func findExecutable(file string) error {
 func fileNotExist(path string) bool {
 	return findExecutable(path) != nil
 }
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
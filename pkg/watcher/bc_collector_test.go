@@ -0,0 +1,137 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"testing"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCommit(hash string, parents ...string) *gitbackend.Commit {
+	return &gitbackend.Commit{
+		Hash:         hash,
+		ParentHashes: parents,
+	}
+}
+
+func TestAdvanceHeads(t *testing.T) {
+	tests := []struct {
+		name      string
+		previous  []string
+		published []*gitbackend.Commit
+		expected  []string
+	}{
+		{
+			name:      "nothing published",
+			previous:  []string{"a"},
+			published: []*gitbackend.Commit{},
+			expected:  []string{"a"},
+		},
+		{
+			name:      "linear history",
+			previous:  []string{"a"},
+			published: []*gitbackend.Commit{testCommit("b", "a"), testCommit("c", "b")},
+			expected:  []string{"c"},
+		},
+		{
+			name:      "part of a branch",
+			previous:  []string{"a"},
+			published: []*gitbackend.Commit{testCommit("b", "a")},
+			expected:  []string{"b"},
+		},
+		{
+			name:      "both sides of a merge before the merge",
+			previous:  []string{"a"},
+			published: []*gitbackend.Commit{testCommit("b", "a"), testCommit("d", "a")},
+			expected:  []string{"b", "d"},
+		},
+		{
+			name:      "the merge",
+			previous:  []string{"b", "d"},
+			published: []*gitbackend.Commit{testCommit("m", "b", "d")},
+			expected:  []string{"m"},
+		},
+		{
+			name:      "a merge of history which was already published",
+			previous:  []string{"c"},
+			published: []*gitbackend.Commit{testCommit("d", "a"), testCommit("m", "c", "d")},
+			expected:  []string{"m"},
+		},
+		{
+			name:      "a head which is not a parent is kept",
+			previous:  []string{"x"},
+			published: []*gitbackend.Commit{testCommit("b", "a")},
+			expected:  []string{"x", "b"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, advanceHeads(test.previous, test.published), test.name)
+	}
+}
+
+func TestBoundaryParents(t *testing.T) {
+	tests := []struct {
+		name     string
+		commits  []*gitbackend.Commit
+		expected []string
+	}{
+		{
+			name:     "no commits",
+			commits:  []*gitbackend.Commit{},
+			expected: []string{},
+		},
+		{
+			name:     "root commit",
+			commits:  []*gitbackend.Commit{testCommit("a"), testCommit("b", "a")},
+			expected: []string{},
+		},
+		{
+			name:     "linear history",
+			commits:  []*gitbackend.Commit{testCommit("b", "a"), testCommit("c", "b")},
+			expected: []string{"a"},
+		},
+		{
+			name:     "a merge with one side outside the commits",
+			commits:  []*gitbackend.Commit{testCommit("c", "b"), testCommit("m", "c", "d"), testCommit("e", "m")},
+			expected: []string{"b", "d"},
+		},
+		{
+			name:     "a parent shared by many commits",
+			commits:  []*gitbackend.Commit{testCommit("b", "a"), testCommit("d", "a")},
+			expected: []string{"a"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, boundaryParents(test.commits), test.name)
+	}
+}
+
+func TestFilterPaths(t *testing.T) {
+	paths := []string{"README.md", "app", "app/main.go", "app/pkg/util.go", "application/main.go"}
+	tests := []struct {
+		dir      string
+		expected []string
+	}{
+		{"app", []string{"app", "app/main.go", "app/pkg/util.go"}},
+		{"app/pkg", []string{"app/pkg/util.go"}},
+		{"docs", []string{}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, filterPaths(paths, test.dir), test.dir)
+	}
+}
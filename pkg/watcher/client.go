@@ -0,0 +1,64 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	buildapi "github.com/openshift/origin/pkg/build/api"
+	oclient "github.com/openshift/origin/pkg/client"
+	projectapi "github.com/openshift/origin/pkg/project/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// openshiftClient is the part of the OpenShift API the Watcher uses to follow the BuildConfigs
+// and Projects so that the tests can replace it
+type openshiftClient interface {
+	ListBuildConfigs(ns string, opts kapi.ListOptions) (*buildapi.BuildConfigList, error)
+	WatchBuildConfigs(ns string, opts kapi.ListOptions) (watch.Interface, error)
+	GetBuildConfig(ns string, name string) (*buildapi.BuildConfig, error)
+	ListProjects(opts kapi.ListOptions) (*projectapi.ProjectList, error)
+	WatchProjects(opts kapi.ListOptions) (watch.Interface, error)
+	GetProject(name string) (*projectapi.Project, error)
+}
+
+// originClient is the openshiftClient of an OpenShift cluster
+type originClient struct {
+	oc *oclient.Client
+}
+
+func (c *originClient) ListBuildConfigs(ns string, opts kapi.ListOptions) (*buildapi.BuildConfigList, error) {
+	return c.oc.BuildConfigs(ns).List(opts)
+}
+
+func (c *originClient) WatchBuildConfigs(ns string, opts kapi.ListOptions) (watch.Interface, error) {
+	return c.oc.BuildConfigs(ns).Watch(opts)
+}
+
+func (c *originClient) GetBuildConfig(ns string, name string) (*buildapi.BuildConfig, error) {
+	return c.oc.BuildConfigs(ns).Get(name)
+}
+
+func (c *originClient) ListProjects(opts kapi.ListOptions) (*projectapi.ProjectList, error) {
+	return c.oc.Projects().List(opts)
+}
+
+func (c *originClient) WatchProjects(opts kapi.ListOptions) (watch.Interface, error) {
+	return c.oc.Projects().Watch(opts)
+}
+
+func (c *originClient) GetProject(name string) (*projectapi.Project, error) {
+	return c.oc.Projects().Get(name)
+}
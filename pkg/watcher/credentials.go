@@ -0,0 +1,79 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"fmt"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+// the keys used in OpenShift source secrets
+const (
+	sourceSecretUsername   = "username"
+	sourceSecretPassword   = "password"
+	sourceSecretSSHKey     = "ssh-privatekey"
+	sourceSecretKnownHosts = "known_hosts"
+	sourceSecretCACert     = "ca.crt"
+)
+
+// loadCredentials loads the credentials from the source secret of the BuildConfig
+// returning nil if it has no source secret
+func (b *Watcher) loadCredentials(bc *buildapi.BuildConfig) (*gitbackend.Credentials, error) {
+	ref := bc.Spec.Source.SourceSecret
+	if ref == nil || len(ref.Name) == 0 {
+		return nil, nil
+	}
+	secret, err := b.kubeClient.Secrets(bc.Namespace).Get(ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the source secret %s in namespace %s due to %v", ref.Name, bc.Namespace, err)
+	}
+	data := secret.Data
+	return &gitbackend.Credentials{
+		Username:      string(data[sourceSecretUsername]),
+		Password:      string(data[sourceSecretPassword]),
+		SSHPrivateKey: data[sourceSecretSSHKey],
+		KnownHosts:    data[sourceSecretKnownHosts],
+		CACert:        data[sourceSecretCACert],
+	}, nil
+}
+
+// backendSource returns the git source of the BuildConfig along with its credentials
+// and proxy configuration for the git backend
+func (b *Watcher) backendSource(bc *buildapi.BuildConfig, gs *buildapi.GitBuildSource) (*gitbackend.Source, error) {
+	creds, err := b.loadCredentials(bc)
+	if err != nil {
+		return nil, err
+	}
+	return &gitbackend.Source{
+		URI:         gs.URI,
+		Ref:         gs.Ref,
+		Credentials: creds,
+		Proxy: gitbackend.Proxy{
+			HTTPProxy:  stringValue(gs.HTTPProxy),
+			HTTPSProxy: stringValue(gs.HTTPSProxy),
+			NoProxy:    stringValue(gs.NoProxy),
+		},
+	}, nil
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
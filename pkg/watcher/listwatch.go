@@ -0,0 +1,192 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+	"k8s.io/kubernetes/pkg/api/meta"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const (
+	minRewatchDelay = 1 * time.Second
+	maxRewatchDelay = 1 * time.Minute
+)
+
+type watchResult int
+
+const (
+	watchStopped watchResult = iota
+	watchClosed
+	watchExpired
+	watchResync
+)
+
+// resyncEvent is sent with the complete list of resources whenever a listWatch
+// relists so that any missed Added or Deleted events can be reconciled
+type resyncEvent struct {
+	kind      string
+	namespace string
+	objects   []runtime.Object
+}
+
+// listWatch keeps a watch on a kind of resource open; re-establishing it from the
+// last resourceVersion when it closes, relisting when the resourceVersion has expired
+// and periodically relisting so that any missed events are reconciled
+type listWatch struct {
+	kind            string
+	namespace       string
+	list            func() ([]runtime.Object, string, error)
+	watch           func(resourceVersion string) (watch.Interface, error)
+	events          chan<- watch.Event
+	resyncs         chan<- resyncEvent
+	resyncPeriod    time.Duration
+	resourceVersion string
+}
+
+// run keeps the watch open until either stop channel is closed
+func (lw *listWatch) run(stopCh <-chan struct{}, doneCh <-chan struct{}) {
+	var resyncCh <-chan time.Time
+	if lw.resyncPeriod > 0 {
+		ticker := time.NewTicker(lw.resyncPeriod)
+		defer ticker.Stop()
+		resyncCh = ticker.C
+	}
+	delay := minRewatchDelay
+	for {
+		if len(lw.resourceVersion) == 0 {
+			err := lw.relist(stopCh, doneCh)
+			if err != nil {
+				util.Warnf("Failed to list %s resources in namespace %s due to %v\n", lw.kind, lw.namespace, err)
+				if !sleepUntilStopped(delay, stopCh, doneCh) {
+					return
+				}
+				delay = nextRewatchDelay(delay)
+				continue
+			}
+		}
+		w, err := lw.watch(lw.resourceVersion)
+		if err != nil {
+			util.Warnf("Failed to watch %s resources in namespace %s due to %v\n", lw.kind, lw.namespace, err)
+			if !sleepUntilStopped(delay, stopCh, doneCh) {
+				return
+			}
+			delay = nextRewatchDelay(delay)
+			continue
+		}
+		delay = minRewatchDelay
+		switch lw.forward(w, resyncCh, stopCh, doneCh) {
+		case watchStopped:
+			return
+		case watchClosed:
+			util.Infof("%s watch closed for namespace %s so rewatching from resourceVersion %s\n", lw.kind, lw.namespace, lw.resourceVersion)
+		case watchExpired:
+			util.Infof("%s watch resourceVersion %s expired for namespace %s so relisting\n", lw.kind, lw.resourceVersion, lw.namespace)
+			lw.resourceVersion = ""
+		case watchResync:
+			lw.resourceVersion = ""
+		}
+	}
+}
+
+// relist lists all the resources and sends them to be reconciled, then remembers
+// the resourceVersion of the list to watch from
+func (lw *listWatch) relist(stopCh <-chan struct{}, doneCh <-chan struct{}) error {
+	objects, resourceVersion, err := lw.list()
+	if err != nil {
+		return err
+	}
+	select {
+	case lw.resyncs <- resyncEvent{kind: lw.kind, namespace: lw.namespace, objects: objects}:
+	case <-stopCh:
+	case <-doneCh:
+	}
+	lw.resourceVersion = resourceVersion
+	return nil
+}
+
+// forward forwards the events of the watch until it closes, expires, a resync is due
+// or we are stopped; remembering the resourceVersion of each event
+func (lw *listWatch) forward(w watch.Interface, resyncCh <-chan time.Time, stopCh <-chan struct{}, doneCh <-chan struct{}) watchResult {
+	defer w.Stop()
+	watchCh := w.ResultChan()
+	for {
+		select {
+		case <-stopCh:
+			return watchStopped
+		case <-doneCh:
+			return watchStopped
+		case <-resyncCh:
+			return watchResync
+		case got, ok := <-watchCh:
+			if !ok {
+				return watchClosed
+			}
+			if got.Type == watch.Error {
+				if isExpired(got.Object) {
+					return watchExpired
+				}
+				util.Warnf("received error while watching for %s in namespace %s: %v\n", lw.kind, lw.namespace, got.Object)
+				continue
+			}
+			if accessor, err := meta.Accessor(got.Object); err == nil {
+				lw.resourceVersion = accessor.GetResourceVersion()
+			}
+			select {
+			case lw.events <- got:
+			case <-stopCh:
+				return watchStopped
+			case <-doneCh:
+				return watchStopped
+			}
+		}
+	}
+}
+
+// isExpired returns true if the watch error means the resourceVersion we watched
+// from is too old and we need to relist
+func isExpired(obj runtime.Object) bool {
+	status, ok := obj.(*unversioned.Status)
+	if !ok || status == nil {
+		return false
+	}
+	return status.Code == http.StatusGone || status.Reason == unversioned.StatusReasonExpired || status.Reason == unversioned.StatusReasonGone
+}
+
+func nextRewatchDelay(delay time.Duration) time.Duration {
+	delay = delay * 2
+	if delay > maxRewatchDelay {
+		delay = maxRewatchDelay
+	}
+	return delay
+}
+
+// sleepUntilStopped sleeps for the delay returning false if we are stopped first
+func sleepUntilStopped(delay time.Duration, stopCh <-chan struct{}, doneCh <-chan struct{}) bool {
+	select {
+	case <-stopCh:
+		return false
+	case <-doneCh:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
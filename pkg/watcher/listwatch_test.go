@@ -0,0 +1,303 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+const testTimeout = 10 * time.Second
+
+// fakeWatch is a watch whose events are sent by the test
+type fakeWatch struct {
+	ch      chan watch.Event
+	stopped chan struct{}
+}
+
+func newFakeWatch() *fakeWatch {
+	return &fakeWatch{
+		ch:      make(chan watch.Event),
+		stopped: make(chan struct{}, 1),
+	}
+}
+
+func (w *fakeWatch) Stop() {
+	select {
+	case w.stopped <- struct{}{}:
+	default:
+	}
+}
+
+func (w *fakeWatch) ResultChan() <-chan watch.Event {
+	return w.ch
+}
+
+// send sends the event failing the test if it is not received
+func (w *fakeWatch) send(t *testing.T, event watch.Event) {
+	select {
+	case w.ch <- event:
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out sending %v", event)
+	}
+}
+
+// fakeListWatch records the lists and watches of a listWatch
+type fakeListWatch struct {
+	lists     int
+	listErrs  []error
+	watchErrs []error
+	watches   chan *fakeWatch
+	versions  chan string
+}
+
+func newFakeListWatch() *fakeListWatch {
+	return &fakeListWatch{
+		watches:  make(chan *fakeWatch, 10),
+		versions: make(chan string, 10),
+	}
+}
+
+// listWatch returns a listWatch of BuildConfigs which lists a single BuildConfig at resourceVersions 10, 20, ...
+func (f *fakeListWatch) listWatch(events chan watch.Event, resyncs chan resyncEvent) *listWatch {
+	return &listWatch{
+		kind:      "BuildConfig",
+		namespace: "myproject",
+		list: func() ([]runtime.Object, string, error) {
+			if len(f.listErrs) > 0 {
+				err := f.listErrs[0]
+				f.listErrs = f.listErrs[1:]
+				return nil, "", err
+			}
+			f.lists++
+			resourceVersion := fmt.Sprintf("%d", f.lists*10)
+			return []runtime.Object{testBuildConfig("myproject", "a", resourceVersion)}, resourceVersion, nil
+		},
+		watch: func(resourceVersion string) (watch.Interface, error) {
+			f.versions <- resourceVersion
+			if len(f.watchErrs) > 0 {
+				err := f.watchErrs[0]
+				f.watchErrs = f.watchErrs[1:]
+				return nil, err
+			}
+			w := newFakeWatch()
+			f.watches <- w
+			return w, nil
+		},
+		events:  events,
+		resyncs: resyncs,
+	}
+}
+
+// nextAttempt waits for the next attempt to watch checking the resourceVersion it watches from
+func (f *fakeListWatch) nextAttempt(t *testing.T, resourceVersion string) {
+	select {
+	case version := <-f.versions:
+		assert.Equal(t, resourceVersion, version, "the resourceVersion watched from")
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for a watch from %s", resourceVersion)
+	}
+}
+
+// nextWatch returns the next watch checking the resourceVersion it watches from
+func (f *fakeListWatch) nextWatch(t *testing.T, resourceVersion string) *fakeWatch {
+	f.nextAttempt(t, resourceVersion)
+	select {
+	case w := <-f.watches:
+		return w
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for a watch from %s", resourceVersion)
+	}
+	return nil
+}
+
+func testBuildConfig(ns string, name string, resourceVersion string) *buildapi.BuildConfig {
+	bc := &buildapi.BuildConfig{}
+	bc.Namespace = ns
+	bc.Name = name
+	bc.ResourceVersion = resourceVersion
+	bc.Spec.Source.Git = &buildapi.GitBuildSource{
+		URI: "https://github.com/fabric8io/" + name + ".git",
+		Ref: "master",
+	}
+	return bc
+}
+
+// runListWatch runs the listWatch returning a function which stops it and waits for it to return
+func runListWatch(t *testing.T, lw *listWatch) func() {
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		lw.run(stopCh, nil)
+		close(done)
+	}()
+	return func() {
+		close(stopCh)
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatalf("Timed out waiting for the %s watch to stop", lw.kind)
+		}
+	}
+}
+
+func receiveEvent(t *testing.T, events chan watch.Event) watch.Event {
+	select {
+	case got := <-events:
+		return got
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	return watch.Event{}
+}
+
+func receiveResync(t *testing.T, resyncs chan resyncEvent) resyncEvent {
+	select {
+	case got := <-resyncs:
+		return got
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for a resync")
+	}
+	return resyncEvent{}
+}
+
+func TestListWatchRelistsWhenExpired(t *testing.T) {
+	events := make(chan watch.Event)
+	resyncs := make(chan resyncEvent)
+	f := newFakeListWatch()
+	stop := runListWatch(t, f.listWatch(events, resyncs))
+	defer stop()
+
+	// there is no resourceVersion to watch from so the BuildConfigs are listed first
+	resync := receiveResync(t, resyncs)
+	assert.Equal(t, "BuildConfig", resync.kind)
+	assert.Equal(t, "myproject", resync.namespace)
+	assert.Len(t, resync.objects, 1)
+	w := f.nextWatch(t, "10")
+
+	w.send(t, watch.Event{Type: watch.Added, Object: testBuildConfig("myproject", "b", "11")})
+	got := receiveEvent(t, events)
+	assert.Equal(t, watch.Added, got.Type)
+	assert.Equal(t, "b", got.Object.(*buildapi.BuildConfig).Name)
+
+	// other errors are ignored
+	w.send(t, watch.Event{Type: watch.Error, Object: &unversioned.Status{Code: http.StatusInternalServerError}})
+	w.send(t, watch.Event{Type: watch.Deleted, Object: testBuildConfig("myproject", "b", "12")})
+	assert.Equal(t, watch.Deleted, receiveEvent(t, events).Type)
+
+	w.send(t, watch.Event{Type: watch.Error, Object: &unversioned.Status{Code: http.StatusGone}})
+	resync = receiveResync(t, resyncs)
+	assert.Len(t, resync.objects, 1)
+	f.nextWatch(t, "20")
+	assert.Equal(t, 2, f.lists)
+}
+
+func TestListWatchRewatchesWhenClosed(t *testing.T) {
+	events := make(chan watch.Event)
+	resyncs := make(chan resyncEvent)
+	f := newFakeListWatch()
+	lw := f.listWatch(events, resyncs)
+	lw.resourceVersion = "5"
+	stop := runListWatch(t, lw)
+	defer stop()
+
+	// the watch starts from the given resourceVersion without listing
+	w := f.nextWatch(t, "5")
+	w.send(t, watch.Event{Type: watch.Modified, Object: testBuildConfig("myproject", "a", "6")})
+	receiveEvent(t, events)
+	close(w.ch)
+
+	// the watch continues from the last event
+	w = f.nextWatch(t, "6")
+	close(w.ch)
+	f.nextWatch(t, "6")
+	assert.Equal(t, 0, f.lists)
+}
+
+func TestListWatchRetriesFailures(t *testing.T) {
+	events := make(chan watch.Event)
+	resyncs := make(chan resyncEvent)
+	f := newFakeListWatch()
+	f.listErrs = []error{fmt.Errorf("connection refused")}
+	f.watchErrs = []error{fmt.Errorf("connection refused")}
+	stop := runListWatch(t, f.listWatch(events, resyncs))
+	defer stop()
+
+	// the list and watch are retried after the first failures
+	receiveResync(t, resyncs)
+	f.nextAttempt(t, "10")
+	f.nextWatch(t, "10")
+	assert.Equal(t, 1, f.lists)
+}
+
+func TestListWatchResyncs(t *testing.T) {
+	events := make(chan watch.Event)
+	resyncs := make(chan resyncEvent)
+	f := newFakeListWatch()
+	lw := f.listWatch(events, resyncs)
+	lw.resyncPeriod = 10 * time.Millisecond
+	stop := runListWatch(t, lw)
+	defer stop()
+
+	receiveResync(t, resyncs)
+	f.nextWatch(t, "10")
+	// the watch is stopped and the BuildConfigs listed again after the resync period
+	receiveResync(t, resyncs)
+	f.nextWatch(t, "20")
+}
+
+func TestIsExpired(t *testing.T) {
+	tests := []struct {
+		name     string
+		obj      runtime.Object
+		expected bool
+	}{
+		{"410", &unversioned.Status{Code: http.StatusGone}, true},
+		{"Expired", &unversioned.Status{Reason: unversioned.StatusReasonExpired}, true},
+		{"Gone", &unversioned.Status{Reason: unversioned.StatusReasonGone}, true},
+		{"500", &unversioned.Status{Code: http.StatusInternalServerError, Reason: "InternalError"}, false},
+		{"nil status", (*unversioned.Status)(nil), false},
+		{"not a status", &kapi.Namespace{}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, isExpired(test.obj), test.name)
+	}
+}
+
+func TestNextRewatchDelay(t *testing.T) {
+	tests := []struct {
+		delay    time.Duration
+		expected time.Duration
+	}{
+		{minRewatchDelay, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{32 * time.Second, maxRewatchDelay},
+		{maxRewatchDelay, maxRewatchDelay},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, nextRewatchDelay(test.delay), test.delay.String())
+	}
+}
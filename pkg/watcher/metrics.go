@@ -0,0 +1,70 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/publisher"
+	"github.com/fabric8io/gitcollector/pkg/util"
+)
+
+// serveMetrics serves the state of the publish outbox of each sink at /metrics in the
+// Prometheus text format so that a backlog of publishes can be alerted on
+func (b *Watcher) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", b.handleMetrics)
+	util.Infof("Serving metrics on %s/metrics\n", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		util.Errorf("Failed to serve metrics on %s due to %v\n", addr, err)
+	}
+}
+
+func (b *Watcher) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	statuses := []publisher.OutboxStatus{}
+	for _, outbox := range b.outboxes {
+		statuses = append(statuses, outbox.Status())
+	}
+	now := time.Now()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP gitcollector_outbox_depth The number of publishes waiting to be delivered")
+	fmt.Fprintln(w, "# TYPE gitcollector_outbox_depth gauge")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gitcollector_outbox_depth{sink=%q} %d\n", s.Sink, s.Depth)
+	}
+	fmt.Fprintln(w, "# HELP gitcollector_outbox_oldest_seconds How long the oldest publish has been waiting to be delivered")
+	fmt.Fprintln(w, "# TYPE gitcollector_outbox_oldest_seconds gauge")
+	for _, s := range statuses {
+		age := 0.0
+		if !s.Oldest.IsZero() {
+			age = now.Sub(s.Oldest).Seconds()
+		}
+		fmt.Fprintf(w, "gitcollector_outbox_oldest_seconds{sink=%q} %g\n", s.Sink, age)
+	}
+	fmt.Fprintln(w, "# HELP gitcollector_outbox_retries_total The number of times delivering a publish has been retried")
+	fmt.Fprintln(w, "# TYPE gitcollector_outbox_retries_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gitcollector_outbox_retries_total{sink=%q} %d\n", s.Sink, s.Retries)
+	}
+	fmt.Fprintln(w, "# HELP gitcollector_outbox_failed_total The number of publishes which failed permanently")
+	fmt.Fprintln(w, "# TYPE gitcollector_outbox_failed_total counter")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "gitcollector_outbox_failed_total{sink=%q} %d\n", s.Sink, s.Failed)
+	}
+}
@@ -0,0 +1,239 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/fabric8io/gitcollector/pkg/util"
+	buildapi "github.com/openshift/origin/pkg/build/api"
+)
+
+const (
+	// mirrorsDir is the directory inside the work directory containing the bare mirrors
+	mirrorsDir = ".mirrors"
+)
+
+var unsafeDirChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// mirror is a bare clone of a git repository shared by all the BuildConfigs using it
+type mirror struct {
+	key string
+	dir string
+
+	// lock serialises cloning, fetching and removing the mirror
+	lock      sync.Mutex
+	lastFetch time.Time
+
+	// the following fields are guarded by the lock of the mirrors
+	// users are the namespaces of the collectors using the mirror by their key
+	users map[string]string
+	// active is the number of workers currently using the mirror so it is not evicted
+	active   int
+	lastUsed time.Time
+	// size is the number of bytes used by the mirror when it was last measured
+	size int64
+}
+
+// mirrors are the reference counted mirrors of the git repositories
+type mirrors struct {
+	dir     string
+	lock    sync.Mutex
+	mirrors map[string]*mirror
+}
+
+func newMirrors(workDir string) *mirrors {
+	return &mirrors{
+		dir:     filepath.Join(workDir, mirrorsDir),
+		mirrors: map[string]*mirror{},
+	}
+}
+
+// mirrorKey returns the key of the mirror of the BuildConfig's git repository.
+//
+// Public repositories are shared by every BuildConfig with the same URI. Repositories
+// cloned with a source secret are only shared by BuildConfigs using the same secret
+// so that a BuildConfig cannot read a private repository it has no credentials for
+func mirrorKey(bc *buildapi.BuildConfig, gs *buildapi.GitBuildSource) string {
+	secret := bc.Spec.Source.SourceSecret
+	if secret == nil || len(secret.Name) == 0 {
+		return gs.URI
+	}
+	return collectorKey(bc.Namespace, secret.Name) + " " + gs.URI
+}
+
+// acquire returns the mirror for the key registering the collector as one of its users
+func (m *mirrors) acquire(key string, namespace string, user string) *mirror {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	answer := m.mirrors[key]
+	if answer == nil {
+		answer = &mirror{
+			key:   key,
+			dir:   filepath.Join(m.dir, mirrorDirName(key)),
+			users: map[string]string{},
+		}
+		m.mirrors[key] = answer
+	}
+	answer.users[user] = namespace
+	return answer
+}
+
+// use marks the mirror as being used by a worker so that it is not evicted
+func (m *mirrors) use(mr *mirror) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mr.active++
+	mr.lastUsed = time.Now()
+}
+
+// done marks the mirror as no longer being used by a worker
+func (m *mirrors) done(mr *mirror) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mr.active--
+}
+
+// measure records the size of the mirror if it changed or its size is not known yet,
+// such as for the mirrors on a persistent volume after a restart, as walking a large
+// mirror after every poll is expensive
+func (m *mirrors) measure(mr *mirror, changed bool) {
+	m.lock.Lock()
+	known := mr.size > 0
+	m.lock.Unlock()
+	if known && !changed {
+		return
+	}
+	size := dirSize(mr.dir)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mr.size = size
+}
+
+// release removes the collector as a user of the mirror. When the mirror has no more users
+// it is removed in the background once any clone or fetch of it has completed
+func (m *mirrors) release(mr *mirror, user string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(mr.users, user)
+	if len(mr.users) == 0 {
+		go m.remove(mr)
+	}
+}
+
+// remove removes the mirror unless it has been acquired again while waiting for its lock
+func (m *mirrors) remove(mr *mirror) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(mr.users) > 0 || m.mirrors[mr.key] != mr {
+		return
+	}
+	delete(m.mirrors, mr.key)
+	removeDir(mr.dir)
+	mr.lastFetch = time.Time{}
+	mr.size = 0
+}
+
+// mirrorDirName returns the directory name of the mirror of the key which is the last part
+// of the repository URI to make it easy to find along with a hash of the key to make it unique
+func mirrorDirName(key string) string {
+	uri := key
+	if i := strings.LastIndex(key, " "); i >= 0 {
+		uri = key[i+1:]
+	}
+	name := strings.TrimSuffix(path.Base(strings.TrimSuffix(uri, "/")), ".git")
+	name = strings.Trim(unsafeDirChars.ReplaceAllString(name, "-"), "-.")
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])[:16]
+	if len(name) == 0 {
+		return hash + ".git"
+	}
+	return name + "-" + hash + ".git"
+}
+
+// sync clones the mirror if it does not exist yet otherwise fetches it, unless it was
+// fetched by another BuildConfig less than maxAge ago and has the ref of the source,
+// so that the mirror is up to date. It returns true if the mirror was cloned or the
+// fetch changed it
+func (mr *mirror) sync(ctx context.Context, backend gitbackend.Backend, source *gitbackend.Source, timeouts *GitTimeouts, maxAge time.Duration) (bool, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	dir := mr.dir
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		validateCtx, cancel := context.WithTimeout(ctx, timeouts.Read)
+		err := backend.Validate(validateCtx, dir, source)
+		cancel()
+		if gitbackend.IsRefNotFound(err) {
+			// the ref may have been created upstream since the mirror was last fetched
+			maxAge = 0
+		} else if err != nil {
+			util.Infof("The mirror %s is not a valid clone of %s due to %v so lets clone it again\n", dir, source.URI, err)
+			removeDir(dir)
+			mr.lastFetch = time.Time{}
+		}
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		util.Infof("Cloning repo %s to %s\n", source.URI, dir)
+		cloneCtx, cancel := context.WithTimeout(ctx, timeouts.Clone)
+		err := backend.Clone(cloneCtx, dir, source)
+		cancel()
+		if err != nil && !gitbackend.IsRefNotFound(err) {
+			// lets not leave a partial clone around
+			removeDir(dir)
+			return false, fmt.Errorf("Failed to clone %s due to %v", source.URI, err)
+		}
+		// the clone is complete even if the ref is missing so lets keep it for the other refs
+		mr.lastFetch = time.Now()
+		return true, err
+	}
+	if !mr.lastFetch.IsZero() && time.Since(mr.lastFetch) < maxAge {
+		return false, nil
+	}
+	util.Infof("git fetch of %s in %s\n", source.URI, dir)
+	fetchCtx, cancel := context.WithTimeout(ctx, timeouts.Fetch)
+	changed, err := backend.Fetch(fetchCtx, dir, source)
+	cancel()
+	if err != nil && !gitbackend.IsRefNotFound(err) {
+		return false, fmt.Errorf("Failed to fetch %s due to %v", source.URI, err)
+	}
+	mr.lastFetch = time.Now()
+	return changed, err
+}
+
+func removeDir(dir string) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	err := os.RemoveAll(dir)
+	if err != nil {
+		util.Warnf("Failed to remove directory %s due to: %v\n", dir, err)
+	} else {
+		util.Infof("Just deleted the folder %s\n", dir)
+	}
+}
@@ -0,0 +1,220 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend counts the clones and fetches creating an empty directory for each clone
+type fakeBackend struct {
+	lock       sync.Mutex
+	clones     int
+	fetches    int
+	invalid    bool
+	missingRef bool
+	// changes is whether the fetches change the mirror
+	changes bool
+}
+
+// refErr returns the error for the ref of the source if it is missing
+func (f *fakeBackend) refErr(source *gitbackend.Source) error {
+	if f.missingRef {
+		return &gitbackend.RefNotFoundError{Ref: source.Ref, URI: source.URI}
+	}
+	return nil
+}
+
+func (f *fakeBackend) Name() string {
+	return "fake"
+}
+
+func (f *fakeBackend) Clone(ctx context.Context, dir string, source *gitbackend.Source) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.clones++
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	return f.refErr(source)
+}
+
+func (f *fakeBackend) Fetch(ctx context.Context, dir string, source *gitbackend.Source) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fetches++
+	return f.changes, f.refErr(source)
+}
+
+func (f *fakeBackend) Validate(ctx context.Context, dir string, source *gitbackend.Source) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.invalid {
+		return fmt.Errorf("The clone %s is of another repository", dir)
+	}
+	return f.refErr(source)
+}
+
+func (f *fakeBackend) Open(ctx context.Context, dir string) (gitbackend.Repository, error) {
+	return nil, fmt.Errorf("the fake backend has no history")
+}
+
+// counts returns the number of clones and fetches
+func (f *fakeBackend) counts() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.clones, f.fetches
+}
+
+func dirExists(dir string) bool {
+	stat, err := os.Stat(dir)
+	return err == nil && stat.IsDir()
+}
+
+func newTestWorkDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitcollector-workdir-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	return dir
+}
+
+func TestMirrorSync(t *testing.T) {
+	tests := []struct {
+		name      string
+		exists    bool
+		invalid   bool
+		missing   bool
+		changes   bool
+		lastFetch time.Duration
+		maxAge    time.Duration
+		clones    int
+		fetches   int
+	}{
+		{name: "missing mirror", clones: 1},
+		{name: "mirror fetched recently", exists: true, lastFetch: time.Second, maxAge: time.Minute},
+		{name: "mirror fetched a while ago", exists: true, lastFetch: time.Hour, maxAge: time.Minute, fetches: 1},
+		{name: "fetch changed the mirror", exists: true, changes: true, lastFetch: time.Hour, maxAge: time.Minute, fetches: 1},
+		{name: "mirror never fetched", exists: true, maxAge: time.Minute, fetches: 1},
+		{name: "fetch requested", exists: true, lastFetch: time.Second, maxAge: 0, fetches: 1},
+		{name: "invalid mirror", exists: true, invalid: true, lastFetch: time.Second, maxAge: time.Minute, clones: 1},
+		{name: "ref missing from the clone", missing: true, clones: 1},
+		{name: "ref missing from the mirror", exists: true, missing: true, lastFetch: time.Second, maxAge: time.Minute, fetches: 1},
+	}
+	timeouts := GitTimeouts{}.withDefaults()
+	source := &gitbackend.Source{URI: "https://github.com/fabric8io/gitcollector.git", Ref: "master"}
+	for _, test := range tests {
+		workDir := newTestWorkDir(t)
+		backend := &fakeBackend{invalid: test.invalid, missingRef: test.missing, changes: test.changes}
+		mr := newMirrors(workDir).acquire(source.URI, "myproject", "myproject/a")
+		if test.exists {
+			assert.NoError(t, os.MkdirAll(mr.dir, 0700))
+		}
+		if test.lastFetch > 0 {
+			mr.lastFetch = time.Now().Add(-test.lastFetch)
+		}
+		changed, err := mr.sync(context.Background(), backend, source, &timeouts, test.maxAge)
+		assert.Equal(t, test.clones > 0 || test.changes, changed, "%s: changed", test.name)
+		if test.missing {
+			assert.True(t, gitbackend.IsRefNotFound(err), "%s: %v", test.name, err)
+			assert.True(t, dirExists(mr.dir), "%s: the mirror should be kept for the other refs", test.name)
+		} else {
+			assert.NoError(t, err, test.name)
+		}
+		clones, fetches := backend.counts()
+		assert.Equal(t, test.clones, clones, "%s: clones", test.name)
+		assert.Equal(t, test.fetches, fetches, "%s: fetches", test.name)
+		if clones+fetches > 0 {
+			assert.WithinDuration(t, time.Now(), mr.lastFetch, time.Minute, test.name)
+		}
+		os.RemoveAll(workDir)
+	}
+}
+
+func TestRequestedPollsFetch(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	defer os.RemoveAll(workDir)
+	b, _ := newTestWatcher(&fakeClient{}, &WatchFlags{WorkDir: workDir})
+	backend := &fakeBackend{}
+	b.backend = backend
+	b.timeouts = GitTimeouts{}.withDefaults()
+	bc := testBuildConfig("myproject", "a", "1")
+	b.addBuildConfig(bc)
+	bw := b.collector("myproject/a")
+	other := testBuildConfig("myproject", "b", "1")
+	other.Spec.Source.Git.URI = bc.Spec.Source.Git.URI
+	b.addBuildConfig(other)
+
+	tests := []struct {
+		name    string
+		poll    func()
+		clones  int
+		fetches int
+	}{
+		{
+			name:   "first poll",
+			clones: 1,
+		},
+		{
+			name: "poll after the mirror was updated",
+		},
+		{
+			name: "build triggered",
+			poll: func() {
+				bc.ResourceVersion = "2"
+				bc.Status.LastVersion = 1
+				b.modifyBuildConfig(bc)
+			},
+			fetches: 1,
+		},
+		{
+			name: "poll after the build",
+		},
+		{
+			name:    "poll now",
+			poll:    bw.pollNow,
+			fetches: 1,
+		},
+		{
+			name: "poll of a BuildConfig using the same mirror",
+			poll: func() {
+				b.collector("myproject/b").Process(context.Background())
+			},
+		},
+	}
+	clones, fetches := 0, 0
+	for _, test := range tests {
+		if test.poll != nil {
+			test.poll()
+		}
+		bw.Process(context.Background())
+		clones += test.clones
+		fetches += test.fetches
+		actualClones, actualFetches := backend.counts()
+		assert.Equal(t, clones, actualClones, "%s: clones", test.name)
+		assert.Equal(t, fetches, actualFetches, "%s: fetches", test.name)
+	}
+}
@@ -0,0 +1,393 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+	buildapi "github.com/openshift/origin/pkg/build/api"
+	projectapi "github.com/openshift/origin/pkg/project/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// namespaceWatch represents the BuildConfig watch of a single namespace (or of all
+// namespaces when namespace is kapi.NamespaceAll) which is stopped by closing stopc
+type namespaceWatch struct {
+	namespace string
+	stopc     chan struct{}
+}
+
+// collectorKey returns the unique key of a BuildConfig across namespaces
+func collectorKey(ns string, name string) string {
+	return ns + "/" + name
+}
+
+// followProjects returns true if the namespaces to watch should track the
+// Projects visible to the operator as they are created and deleted
+func (b *Watcher) followProjects() bool {
+	flags := b.flags
+	return !flags.AllNamespaces && (flags.FollowProjects || len(flags.NamespaceSelector) > 0)
+}
+
+// projectListOptions returns the options to list or watch the Projects to follow
+func (b *Watcher) projectListOptions() (kapi.ListOptions, error) {
+	opts := kapi.ListOptions{}
+	text := b.flags.NamespaceSelector
+	if len(text) > 0 {
+		selector, err := labels.Parse(text)
+		if err != nil {
+			return opts, fmt.Errorf("Failed to parse namespace selector %s due to %v", text, err)
+		}
+		opts.LabelSelector = selector
+	}
+	return opts, nil
+}
+
+// buildConfigListOptions returns the options to list or watch the BuildConfigs to collect
+func (b *Watcher) buildConfigListOptions() (kapi.ListOptions, error) {
+	opts := kapi.ListOptions{}
+	text := b.flags.BuildConfigSelector
+	if len(text) > 0 {
+		selector, err := labels.Parse(text)
+		if err != nil {
+			return opts, fmt.Errorf("Failed to parse BuildConfig selector %s due to %v", text, err)
+		}
+		opts.LabelSelector = selector
+	}
+	return opts, nil
+}
+
+// resolveNamespaces returns the namespaces to watch based on the flags along with the
+// resourceVersion of the Projects list if we are following Projects.
+// If all namespaces are to be watched then a single kapi.NamespaceAll is returned
+func (b *Watcher) resolveNamespaces() ([]string, string, error) {
+	flags := b.flags
+	if flags.AllNamespaces {
+		util.Info("Watching BuildConfigs in all namespaces\n")
+		return []string{kapi.NamespaceAll}, "", nil
+	}
+	names := map[string]bool{}
+	if len(flags.Namespace) > 0 {
+		names[flags.Namespace] = true
+	}
+	for _, ns := range flags.Namespaces {
+		if len(ns) > 0 {
+			names[ns] = true
+		}
+	}
+	resourceVersion := ""
+	if b.followProjects() {
+		opts, err := b.projectListOptions()
+		if err != nil {
+			return nil, "", err
+		}
+		pl, err := b.osClient.ListProjects(opts)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to find projects due to %v", err)
+		}
+		for _, p := range pl.Items {
+			if isActiveProject(&p) {
+				names[p.Name] = true
+			}
+		}
+		resourceVersion = pl.ResourceVersion
+	}
+	if len(names) == 0 && !b.followProjects() {
+		return nil, "", fmt.Errorf("No namespaces to watch")
+	}
+	answer := []string{}
+	for ns := range names {
+		answer = append(answer, ns)
+	}
+	sort.Strings(answer)
+	util.Infof("Watching BuildConfigs in namespaces %v\n", answer)
+	return answer, resourceVersion, nil
+}
+
+// watchNamespace lists the current BuildConfigs in the given namespace then
+// watches for changes, forwarding the events to the Watcher until stopCh is closed
+// or the namespace is no longer watched
+func (b *Watcher) watchNamespace(ns string, stopCh <-chan struct{}) error {
+	if b.watches[ns] != nil {
+		return nil
+	}
+	lw := b.newBuildConfigListWatch(ns)
+	objects, resourceVersion, err := lw.list()
+	if err != nil {
+		return err
+	}
+	util.Infof("Found %d BuildConfigs in namespace %s\n", len(objects), ns)
+	lw.resourceVersion = resourceVersion
+
+	nw := &namespaceWatch{
+		namespace: ns,
+		stopc:     make(chan struct{}),
+	}
+	b.watches[ns] = nw
+	b.reconcileBuildConfigs(ns, objects)
+	go lw.run(stopCh, nw.stopc)
+	return nil
+}
+
+func (b *Watcher) newBuildConfigListWatch(ns string) *listWatch {
+	client := b.osClient
+	return &listWatch{
+		kind:      "BuildConfig",
+		namespace: ns,
+		list: func() ([]runtime.Object, string, error) {
+			opts, err := b.buildConfigListOptions()
+			if err != nil {
+				return nil, "", err
+			}
+			bcl, err := client.ListBuildConfigs(ns, opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("Failed to find BuildConfig resources in namespace %s due to %v", ns, err)
+			}
+			objects := []runtime.Object{}
+			for i := range bcl.Items {
+				objects = append(objects, &bcl.Items[i])
+			}
+			return objects, bcl.ResourceVersion, nil
+		},
+		watch: func(resourceVersion string) (watch.Interface, error) {
+			opts, err := b.buildConfigListOptions()
+			if err != nil {
+				return nil, err
+			}
+			opts.ResourceVersion = resourceVersion
+			return client.WatchBuildConfigs(ns, opts)
+		},
+		events:       b.events,
+		resyncs:      b.resyncs,
+		resyncPeriod: b.flags.ResyncPeriod,
+	}
+}
+
+// reconcileBuildConfigs upserts the given BuildConfigs which are new or changed and
+// removes any collectors in the namespace for BuildConfigs which no longer exist
+func (b *Watcher) reconcileBuildConfigs(ns string, objects []runtime.Object) {
+	keys := map[string]bool{}
+	for _, obj := range objects {
+		bc, ok := obj.(*buildapi.BuildConfig)
+		if !ok || bc == nil {
+			continue
+		}
+		key := collectorKey(bc.Namespace, bc.Name)
+		keys[key] = true
+		bw := b.collector(key)
+		if bw == nil {
+			b.addBuildConfig(bc)
+		} else if bw.BuildConfig().ResourceVersion != bc.ResourceVersion {
+			b.modifyBuildConfig(bc)
+		}
+	}
+	removed := []*buildapi.BuildConfig{}
+	for _, bw := range b.snapshotCollectors() {
+		if (ns == kapi.NamespaceAll || bw.namespace == ns) && !keys[bw.key()] {
+			bc := bw.BuildConfig()
+			removed = append(removed, &bc)
+		}
+	}
+	for _, bc := range removed {
+		b.deleteBuildConfig(bc)
+	}
+}
+
+// unwatchNamespace stops watching the given namespace, removing all of its
+// BuildConfigCollectors along with any mirrors no other BuildConfig uses and
+// unpublishing their BuildConfigs with the given mode
+func (b *Watcher) unwatchNamespace(ns string, mode unpublishMode) {
+	nw := b.watches[ns]
+	if nw == nil {
+		return
+	}
+	util.Infof("No longer watching BuildConfigs in namespace %s\n", ns)
+	close(nw.stopc)
+	delete(b.watches, ns)
+
+	b.lock.Lock()
+	collectors := []*BuildConfigCollector{}
+	removed := []*BuildConfigCollector{}
+	for _, bw := range b.collectors {
+		if bw.namespace == ns {
+			removed = append(removed, bw)
+		} else {
+			collectors = append(collectors, bw)
+		}
+	}
+	b.collectors = collectors
+	b.lock.Unlock()
+
+	for _, bw := range removed {
+		bw.Delete(mode)
+	}
+}
+
+// removedProjectUnpublishMode returns how to unpublish the BuildConfigs of a namespace which is
+// no longer watched. They are deleted from the sinks, subject to the commit retention, when the
+// Project was deleted or is terminating. When the Project still exists it only stopped matching
+// the namespace selector so the BuildConfigs still exist and what was published is kept
+func (b *Watcher) removedProjectUnpublishMode(ns string, p *projectapi.Project) unpublishMode {
+	if p != nil && !isActiveProject(p) {
+		return unpublishBuildConfig
+	}
+	current, err := b.osClient.GetProject(ns)
+	if kerrors.IsNotFound(err) {
+		return unpublishBuildConfig
+	}
+	if err != nil {
+		util.Warnf("Keeping what was published for namespace %s as we failed to find its Project due to %v\n", ns, err)
+		return unpublishNone
+	}
+	if !isActiveProject(current) {
+		return unpublishBuildConfig
+	}
+	return unpublishNone
+}
+
+// isWatchedNamespace returns true if BuildConfigs in the given namespace are being watched
+func (b *Watcher) isWatchedNamespace(ns string) bool {
+	if b.flags.AllNamespaces {
+		return true
+	}
+	return b.watches[ns] != nil
+}
+
+// watchProjects watches the Projects visible to the operator from the given
+// resourceVersion so that namespaces are watched as Projects are created and deleted
+func (b *Watcher) watchProjects(resourceVersion string, stopCh <-chan struct{}) error {
+	opts, err := b.projectListOptions()
+	if err != nil {
+		return err
+	}
+	client := b.osClient
+	lw := &listWatch{
+		kind: "Project",
+		list: func() ([]runtime.Object, string, error) {
+			pl, err := client.ListProjects(opts)
+			if err != nil {
+				return nil, "", fmt.Errorf("Failed to find projects due to %v", err)
+			}
+			objects := []runtime.Object{}
+			for i := range pl.Items {
+				objects = append(objects, &pl.Items[i])
+			}
+			return objects, pl.ResourceVersion, nil
+		},
+		watch: func(resourceVersion string) (watch.Interface, error) {
+			watchOpts := opts
+			watchOpts.ResourceVersion = resourceVersion
+			return client.WatchProjects(watchOpts)
+		},
+		events:          b.projectEvents,
+		resyncs:         b.resyncs,
+		resyncPeriod:    b.flags.ResyncPeriod,
+		resourceVersion: resourceVersion,
+	}
+	go lw.run(stopCh, nil)
+	return nil
+}
+
+// reconcileProjects watches any active Projects which are not yet watched and stops
+// watching namespaces whose Projects no longer exist, are terminating or no longer match
+func (b *Watcher) reconcileProjects(objects []runtime.Object, stopCh <-chan struct{}) {
+	active := map[string]bool{}
+	projects := map[string]*projectapi.Project{}
+	for _, obj := range objects {
+		p, ok := obj.(*projectapi.Project)
+		if !ok || p == nil {
+			continue
+		}
+		projects[p.Name] = p
+		if !isActiveProject(p) {
+			continue
+		}
+		active[p.Name] = true
+		err := b.watchNamespace(p.Name, stopCh)
+		if err != nil {
+			util.Warnf("%v\n", err)
+		}
+	}
+	removed := []string{}
+	for ns := range b.watches {
+		if !active[ns] && !b.isConfiguredNamespace(ns) {
+			removed = append(removed, ns)
+		}
+	}
+	for _, ns := range removed {
+		b.unwatchNamespace(ns, b.removedProjectUnpublishMode(ns, projects[ns]))
+	}
+}
+
+// onResync reconciles the complete list of resources from a relist
+func (b *Watcher) onResync(got resyncEvent, stopCh <-chan struct{}) {
+	switch got.kind {
+	case "BuildConfig":
+		if b.isWatchedNamespace(got.namespace) {
+			b.reconcileBuildConfigs(got.namespace, got.objects)
+		}
+	case "Project":
+		b.reconcileProjects(got.objects, stopCh)
+	}
+}
+
+// isConfiguredNamespace returns true if the namespace was explicitly configured via the flags
+func (b *Watcher) isConfiguredNamespace(ns string) bool {
+	if ns == b.flags.Namespace {
+		return true
+	}
+	for _, n := range b.flags.Namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Watcher) onProjectEvent(got watch.Event, stopCh <-chan struct{}) {
+	p, isProject := got.Object.(*projectapi.Project)
+	if !isProject || p == nil {
+		util.Warnf("received unknown object while watching for Project: %v\n", got.Object)
+		return
+	}
+	ns := p.Name
+	switch got.Type {
+	case watch.Added, watch.Modified:
+		if !isActiveProject(p) {
+			b.unwatchNamespace(ns, unpublishBuildConfig)
+			return
+		}
+		err := b.watchNamespace(ns, stopCh)
+		if err != nil {
+			util.Warnf("%v\n", err)
+		}
+	case watch.Deleted:
+		// a Project which no longer matches the namespace selector is also deleted from the watch
+		if b.watches[ns] != nil {
+			b.unwatchNamespace(ns, b.removedProjectUnpublishMode(ns, p))
+		}
+	}
+}
+
+func isActiveProject(p *projectapi.Project) bool {
+	return p.DeletionTimestamp == nil && p.Status.Phase != kapi.NamespaceTerminating
+}
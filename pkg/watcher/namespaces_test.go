@@ -0,0 +1,374 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/fabric8io/gitcollector/pkg/publisher"
+	"github.com/fabric8io/gitcollector/pkg/state"
+	"github.com/stretchr/testify/assert"
+
+	buildapi "github.com/openshift/origin/pkg/build/api"
+	projectapi "github.com/openshift/origin/pkg/project/api"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// fakeClient is an openshiftClient with the given BuildConfigs and Projects whose watches never send any events
+type fakeClient struct {
+	lock         sync.Mutex
+	buildConfigs []*buildapi.BuildConfig
+	projects     []*projectapi.Project
+}
+
+func (c *fakeClient) ListBuildConfigs(ns string, opts kapi.ListOptions) (*buildapi.BuildConfigList, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	answer := &buildapi.BuildConfigList{}
+	answer.ResourceVersion = "1"
+	for _, bc := range c.buildConfigs {
+		if ns == kapi.NamespaceAll || bc.Namespace == ns {
+			answer.Items = append(answer.Items, *bc)
+		}
+	}
+	return answer, nil
+}
+
+func (c *fakeClient) WatchBuildConfigs(ns string, opts kapi.ListOptions) (watch.Interface, error) {
+	return newFakeWatch(), nil
+}
+
+func (c *fakeClient) GetBuildConfig(ns string, name string) (*buildapi.BuildConfig, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, bc := range c.buildConfigs {
+		if bc.Namespace == ns && bc.Name == name {
+			return bc, nil
+		}
+	}
+	return nil, kerrors.NewNotFound(kapi.Resource("buildconfigs"), name)
+}
+
+func (c *fakeClient) ListProjects(opts kapi.ListOptions) (*projectapi.ProjectList, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	answer := &projectapi.ProjectList{}
+	answer.ResourceVersion = "1"
+	for _, p := range c.projects {
+		answer.Items = append(answer.Items, *p)
+	}
+	return answer, nil
+}
+
+func (c *fakeClient) WatchProjects(opts kapi.ListOptions) (watch.Interface, error) {
+	return newFakeWatch(), nil
+}
+
+func (c *fakeClient) GetProject(name string) (*projectapi.Project, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, p := range c.projects {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, kerrors.NewNotFound(kapi.Resource("projects"), name)
+}
+
+// recordingSink records what is published to it
+type recordingSink struct {
+	lock      sync.Mutex
+	published []string
+}
+
+func (s *recordingSink) record(text string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.published = append(s.published, text)
+	return nil
+}
+
+// Published returns what was published and clears it
+func (s *recordingSink) Published() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	answer := append([]string{}, s.published...)
+	s.published = nil
+	return answer
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) UpsertBuildConfig(bc *buildapi.BuildConfig) error {
+	return s.record("upsertBuildConfig " + collectorKey(bc.Namespace, bc.Name))
+}
+
+func (s *recordingSink) UpsertGitCommits(dtos []*publisher.BuildConfigCommit) error {
+	for _, dto := range dtos {
+		s.record("upsertGitCommit " + collectorKey(dto.Namespace, dto.BuildConfigName) + " " + dto.Hash)
+	}
+	return nil
+}
+
+func (s *recordingSink) UpsertHistoryRewritten(dto *publisher.HistoryRewritten) error {
+	return s.record("upsertHistoryRewritten " + collectorKey(dto.Namespace, dto.BuildConfigName))
+}
+
+func (s *recordingSink) DeleteBuildConfig(namespace string, name string) error {
+	return s.record("deleteBuildConfig " + collectorKey(namespace, name))
+}
+
+func (s *recordingSink) DeleteGitCommits(namespace string, name string) error {
+	return s.record("deleteGitCommits " + collectorKey(namespace, name))
+}
+
+// newTestWatcher returns a Watcher using the client which publishes to the returned sink
+func newTestWatcher(client openshiftClient, flags *WatchFlags) (*Watcher, *recordingSink) {
+	sink := &recordingSink{}
+	b := &Watcher{
+		osClient:      client,
+		publisher:     sink,
+		stateStore:    state.NewNoopStore(),
+		mirrors:       newMirrors(flags.WorkDir),
+		flags:         flags,
+		watches:       map[string]*namespaceWatch{},
+		events:        make(chan watch.Event),
+		projectEvents: make(chan watch.Event),
+		resyncs:       make(chan resyncEvent),
+		workDir:       flags.WorkDir,
+		schedule:      flags.Schedule.withDefaults(),
+		collectors:    []*BuildConfigCollector{},
+	}
+	return b, sink
+}
+
+func testProject(name string, phase kapi.NamespacePhase) *projectapi.Project {
+	p := &projectapi.Project{}
+	p.Name = name
+	p.Status.Phase = phase
+	return p
+}
+
+// collectorKeys returns the sorted keys of the collectors of the Watcher
+func collectorKeys(b *Watcher) []string {
+	answer := []string{}
+	for _, bw := range b.snapshotCollectors() {
+		answer = append(answer, bw.key())
+	}
+	sort.Strings(answer)
+	return answer
+}
+
+// watchedNamespaces returns the sorted namespaces the Watcher is watching
+func watchedNamespaces(b *Watcher) []string {
+	answer := []string{}
+	for ns := range b.watches {
+		answer = append(answer, ns)
+	}
+	sort.Strings(answer)
+	return answer
+}
+
+func TestReconcileBuildConfigs(t *testing.T) {
+	b, sink := newTestWatcher(&fakeClient{}, &WatchFlags{})
+	b.addBuildConfig(testBuildConfig("one", "a", "1"))
+	b.addBuildConfig(testBuildConfig("one", "b", "1"))
+	b.addBuildConfig(testBuildConfig("two", "c", "1"))
+	sink.Published()
+
+	tests := []struct {
+		name      string
+		namespace string
+		objects   []runtime.Object
+		expected  []string
+		published []string
+	}{
+		{
+			name:      "added and modified BuildConfigs",
+			namespace: "one",
+			objects: []runtime.Object{
+				testBuildConfig("one", "a", "1"),
+				testBuildConfig("one", "b", "2"),
+				testBuildConfig("one", "d", "1"),
+			},
+			expected:  []string{"one/a", "one/b", "one/d", "two/c"},
+			published: []string{"upsertBuildConfig one/b", "upsertBuildConfig one/d"},
+		},
+		{
+			// the modified BuildConfig is not updated again
+			name:      "deleted BuildConfigs",
+			namespace: "one",
+			objects: []runtime.Object{
+				testBuildConfig("one", "b", "2"),
+			},
+			expected:  []string{"one/b", "two/c"},
+			published: []string{"deleteBuildConfig one/a", "deleteGitCommits one/a", "deleteBuildConfig one/d", "deleteGitCommits one/d"},
+		},
+		{
+			name:      "all namespaces",
+			namespace: kapi.NamespaceAll,
+			objects: []runtime.Object{
+				testBuildConfig("two", "c", "1"),
+				testBuildConfig("three", "e", "1"),
+			},
+			expected:  []string{"three/e", "two/c"},
+			published: []string{"upsertBuildConfig three/e", "deleteBuildConfig one/b", "deleteGitCommits one/b"},
+		},
+	}
+	for _, test := range tests {
+		b.reconcileBuildConfigs(test.namespace, test.objects)
+		assert.Equal(t, test.expected, collectorKeys(b), test.name)
+		assert.Equal(t, test.published, sink.Published(), test.name)
+	}
+}
+
+func TestReconcileProjects(t *testing.T) {
+	client := &fakeClient{
+		buildConfigs: []*buildapi.BuildConfig{
+			testBuildConfig("configured", "a", "1"),
+			testBuildConfig("one", "b", "1"),
+			testBuildConfig("two", "c", "1"),
+			testBuildConfig("three", "d", "1"),
+		},
+	}
+	b, sink := newTestWatcher(client, &WatchFlags{Namespaces: []string{"configured"}, FollowProjects: true})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	assert.NoError(t, b.watchNamespace("configured", stopCh))
+	sink.Published()
+
+	tests := []struct {
+		name       string
+		projects   []runtime.Object
+		existing   []*projectapi.Project
+		namespaces []string
+		collectors []string
+		published  []string
+	}{
+		{
+			name: "new projects",
+			projects: []runtime.Object{
+				testProject("one", kapi.NamespaceActive),
+				testProject("two", kapi.NamespaceActive),
+				testProject("three", kapi.NamespaceTerminating),
+			},
+			namespaces: []string{"configured", "one", "two"},
+			collectors: []string{"configured/a", "one/b", "two/c"},
+			published:  []string{"upsertBuildConfig one/b", "upsertBuildConfig two/c"},
+		},
+		{
+			name: "removed and terminating projects",
+			projects: []runtime.Object{
+				testProject("two", kapi.NamespaceTerminating),
+				testProject("three", kapi.NamespaceActive),
+			},
+			namespaces: []string{"configured", "three"},
+			collectors: []string{"configured/a", "three/d"},
+			published: []string{
+				"deleteBuildConfig one/b", "deleteBuildConfig two/c",
+				"deleteGitCommits one/b", "deleteGitCommits two/c",
+				"upsertBuildConfig three/d",
+			},
+		},
+		{
+			// the project no longer matches the namespace selector
+			name:       "project which still exists",
+			existing:   []*projectapi.Project{testProject("three", kapi.NamespaceActive)},
+			namespaces: []string{"configured"},
+			collectors: []string{"configured/a"},
+			published:  []string{},
+		},
+	}
+	for _, test := range tests {
+		client.lock.Lock()
+		client.projects = test.existing
+		client.lock.Unlock()
+		b.reconcileProjects(test.projects, stopCh)
+		assert.Equal(t, test.namespaces, watchedNamespaces(b), test.name)
+		assert.Equal(t, test.collectors, collectorKeys(b), test.name)
+		published := sink.Published()
+		sort.Strings(published)
+		assert.Equal(t, test.published, published, test.name)
+	}
+}
+
+func TestProjectEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     watch.Event
+		existing  []*projectapi.Project
+		retention string
+		watched   bool
+		published []string
+	}{
+		{
+			name:      "modified project",
+			event:     watch.Event{Type: watch.Modified, Object: testProject("one", kapi.NamespaceActive)},
+			watched:   true,
+			published: []string{},
+		},
+		{
+			name:      "terminating project",
+			event:     watch.Event{Type: watch.Modified, Object: testProject("one", kapi.NamespaceTerminating)},
+			published: []string{"deleteBuildConfig one/a", "deleteGitCommits one/a"},
+		},
+		{
+			name:      "deleted project",
+			event:     watch.Event{Type: watch.Deleted, Object: testProject("one", kapi.NamespaceActive)},
+			published: []string{"deleteBuildConfig one/a", "deleteGitCommits one/a"},
+		},
+		{
+			name:      "deleted project keeping its commits",
+			event:     watch.Event{Type: watch.Deleted, Object: testProject("one", kapi.NamespaceTerminating)},
+			retention: CommitRetentionKeep,
+			published: []string{"deleteBuildConfig one/a"},
+		},
+		{
+			name:      "project no longer matching the namespace selector",
+			event:     watch.Event{Type: watch.Deleted, Object: testProject("one", kapi.NamespaceActive)},
+			existing:  []*projectapi.Project{testProject("one", kapi.NamespaceActive)},
+			published: []string{},
+		},
+	}
+	for _, test := range tests {
+		client := &fakeClient{
+			buildConfigs: []*buildapi.BuildConfig{testBuildConfig("one", "a", "1")},
+			projects:     test.existing,
+		}
+		b, sink := newTestWatcher(client, &WatchFlags{FollowProjects: true, CommitRetention: test.retention})
+		stopCh := make(chan struct{})
+		assert.NoError(t, b.watchNamespace("one", stopCh))
+		sink.Published()
+
+		b.onProjectEvent(test.event, stopCh)
+		if test.watched {
+			assert.Equal(t, []string{"one"}, watchedNamespaces(b), test.name)
+			assert.Equal(t, []string{"one/a"}, collectorKeys(b), test.name)
+		} else {
+			assert.Equal(t, []string{}, watchedNamespaces(b), test.name)
+			assert.Equal(t, []string{}, collectorKeys(b), test.name)
+		}
+		assert.Equal(t, test.published, sink.Published(), test.name)
+		close(stopCh)
+	}
+}
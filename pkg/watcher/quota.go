@@ -0,0 +1,214 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/util"
+)
+
+// DiskQuota limits the disk space used by the mirrors in the work directory.
+//
+// When a limit is exceeded the least recently processed mirrors are evicted
+// and are cloned again the next time they are processed. A limit of zero
+// means no limit
+type DiskQuota struct {
+	// Total is the maximum number of bytes used by all the mirrors
+	Total int64
+
+	// Namespace is the maximum number of bytes used by the mirrors of the BuildConfigs of
+	// each namespace; a mirror shared by several namespaces counts fully against each of them
+	Namespace int64
+}
+
+// enabled returns true if either limit is set
+func (q *DiskQuota) enabled() bool {
+	return q.Total > 0 || q.Namespace > 0
+}
+
+// enforceQuota evicts the least recently used mirrors until the disk quota is met
+func (m *mirrors) enforceQuota(quota *DiskQuota) {
+	if !quota.enabled() {
+		return
+	}
+	for {
+		victim, reason := m.nextEviction(quota)
+		if victim == nil {
+			if len(reason) > 0 {
+				util.Warnf("The mirrors exceed the disk quota as %s but they are all in use\n", reason)
+			}
+			return
+		}
+		util.Infof("Evicting the mirror %s as %s\n", victim.dir, reason)
+		m.evict(victim)
+	}
+}
+
+// nextEviction returns the least recently used mirror which is not in use to evict so that
+// the quota is met along with the reason why, or nil if the quota is met
+func (m *mirrors) nextEviction(quota *DiskQuota) (*mirror, string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	candidates := []*mirror{}
+	var total int64
+	namespaces := map[string]int64{}
+	for _, mr := range m.mirrors {
+		if mr.size == 0 {
+			continue
+		}
+		total += mr.size
+		for ns := range mirrorNamespaces(mr) {
+			namespaces[ns] += mr.size
+		}
+		if mr.active == 0 {
+			candidates = append(candidates, mr)
+		}
+	}
+	sort.Sort(byLastUsed(candidates))
+
+	if quota.Total > 0 && total > quota.Total {
+		reason := "the total size " + formatBytes(total) + " is over " + formatBytes(quota.Total)
+		if len(candidates) == 0 {
+			return nil, reason
+		}
+		return candidates[0], reason
+	}
+	if quota.Namespace > 0 {
+		for ns, size := range namespaces {
+			if size <= quota.Namespace {
+				continue
+			}
+			reason := "the size " + formatBytes(size) + " of namespace " + ns + " is over " + formatBytes(quota.Namespace)
+			for _, mr := range candidates {
+				if mirrorNamespaces(mr)[ns] {
+					return mr, reason
+				}
+			}
+			return nil, reason
+		}
+	}
+	return nil, ""
+}
+
+// evict removes the directory of the mirror unless a worker started using it
+// while waiting for any clone or fetch to complete
+func (m *mirrors) evict(mr *mirror) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if mr.active > 0 {
+		return
+	}
+	removeDir(mr.dir)
+	mr.lastFetch = time.Time{}
+	mr.size = 0
+}
+
+// mirrorNamespaces returns the namespaces of the users of the mirror; the lock of the mirrors must be held
+func mirrorNamespaces(mr *mirror) map[string]bool {
+	answer := map[string]bool{}
+	for _, ns := range mr.users {
+		answer[ns] = true
+	}
+	return answer
+}
+
+type byLastUsed []*mirror
+
+func (c byLastUsed) Len() int           { return len(c) }
+func (c byLastUsed) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byLastUsed) Less(i, j int) bool { return c[i].lastUsed.Before(c[j].lastUsed) }
+
+// sweepWorkDir removes the mirrors in the work directory which are not used by any of the
+// current BuildConfigs, such as when BuildConfigs were deleted while the operator was down,
+// along with any clones of BuildConfigs in {workdir}/{namespace}/{name} from older versions
+func (b *Watcher) sweepWorkDir() {
+	expected := map[string]bool{}
+	for _, bw := range b.snapshotCollectors() {
+		bc := bw.BuildConfig()
+		gs := b.GitSource(&bc)
+		if gs != nil && len(gs.URI) > 0 {
+			expected[mirrorDirName(mirrorKey(&bc, gs))] = true
+		}
+	}
+	dir := b.mirrors.dir
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		util.Warnf("Failed to read the mirrors directory %s due to %v\n", dir, err)
+	}
+	for _, file := range files {
+		if !expected[file.Name()] {
+			util.Infof("Removing the mirror %s as no BuildConfig uses it\n", file.Name())
+			removeDir(filepath.Join(dir, file.Name()))
+		}
+	}
+
+	namespaceDirs, err := ioutil.ReadDir(b.workDir)
+	if err != nil {
+		util.Warnf("Failed to read the work directory %s due to %v\n", b.workDir, err)
+		return
+	}
+	for _, namespaceDir := range namespaceDirs {
+		if !namespaceDir.IsDir() || strings.HasPrefix(namespaceDir.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(b.workDir, namespaceDir.Name())
+		clones, err := ioutil.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, clone := range clones {
+			clonePath := filepath.Join(path, clone.Name())
+			if stat, err := os.Stat(filepath.Join(clonePath, ".git")); err == nil && stat.IsDir() {
+				util.Infof("Removing the old clone %s\n", clonePath)
+				removeDir(clonePath)
+			}
+		}
+		// only removes the directory if it is now empty
+		os.Remove(path)
+	}
+}
+
+// dirSize returns the number of bytes used by the files in the directory
+func dirSize(dir string) int64 {
+	var answer int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			answer += info.Size()
+		}
+		return nil
+	})
+	return answer
+}
+
+func formatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value = value / 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + units[i]
+}
@@ -0,0 +1,232 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMirror describes a mirror used by the BuildConfigs of the namespaces
+type testMirror struct {
+	name       string
+	namespaces []string
+	size       int64
+	active     int
+	// lastUsed is how long ago the mirror was last used
+	lastUsed time.Duration
+}
+
+// newTestMirrors returns the mirrors in the work directory
+func newTestMirrors(workDir string, testMirrors []testMirror) *mirrors {
+	m := newMirrors(workDir)
+	now := time.Now()
+	for _, tm := range testMirrors {
+		mr := m.acquire(tm.name, "", "")
+		mr.users = map[string]string{}
+		for _, ns := range tm.namespaces {
+			mr.users[ns+"/"+tm.name] = ns
+		}
+		mr.size = tm.size
+		mr.active = tm.active
+		mr.lastUsed = now.Add(-tm.lastUsed)
+	}
+	return m
+}
+
+func TestNextEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		mirrors []testMirror
+		quota   DiskQuota
+		victim  string
+		reason  string
+	}{
+		{
+			name: "under the total quota",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, lastUsed: time.Hour},
+				{name: "b", namespaces: []string{"ns2"}, size: 100},
+			},
+			quota: DiskQuota{Total: 200},
+		},
+		{
+			name: "least recently used over the total quota",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, lastUsed: time.Minute},
+				{name: "b", namespaces: []string{"ns2"}, size: 100, lastUsed: time.Hour},
+				{name: "c", namespaces: []string{"ns2"}, size: 100},
+			},
+			quota:  DiskQuota{Total: 250},
+			victim: "b",
+			reason: "the total size 300.0B is over 250.0B",
+		},
+		{
+			name: "mirrors in use are not evicted",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, lastUsed: time.Minute},
+				{name: "b", namespaces: []string{"ns2"}, size: 100, lastUsed: time.Hour, active: 1},
+			},
+			quota:  DiskQuota{Total: 150},
+			victim: "a",
+			reason: "the total size 200.0B is over 150.0B",
+		},
+		{
+			name: "all mirrors in use",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, active: 1},
+				{name: "b", namespaces: []string{"ns2"}, size: 100, active: 2},
+			},
+			quota:  DiskQuota{Total: 150},
+			reason: "the total size 200.0B is over 150.0B",
+		},
+		{
+			name: "evicted mirrors are not counted",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 0, lastUsed: time.Hour},
+				{name: "b", namespaces: []string{"ns2"}, size: 100},
+			},
+			quota: DiskQuota{Total: 100},
+		},
+		{
+			name: "least recently used of the namespace over its quota",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, lastUsed: time.Hour},
+				{name: "b", namespaces: []string{"ns2"}, size: 1024, lastUsed: time.Minute},
+				{name: "c", namespaces: []string{"ns2"}, size: 1024},
+			},
+			quota:  DiskQuota{Total: 4096, Namespace: 1500},
+			victim: "b",
+			reason: "the size 2.0KiB of namespace ns2 is over 1.5KiB",
+		},
+		{
+			name: "shared mirrors count against each namespace",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 40, lastUsed: time.Hour},
+				{name: "b", namespaces: []string{"ns1", "ns2"}, size: 100, lastUsed: time.Minute},
+				{name: "c", namespaces: []string{"ns2"}, size: 100, active: 1},
+			},
+			quota:  DiskQuota{Namespace: 150},
+			victim: "b",
+			reason: "the size 200.0B of namespace ns2 is over 150.0B",
+		},
+		{
+			name: "namespace mirrors all in use",
+			mirrors: []testMirror{
+				{name: "a", namespaces: []string{"ns1"}, size: 100, lastUsed: time.Hour},
+				{name: "b", namespaces: []string{"ns2"}, size: 100, active: 1},
+				{name: "c", namespaces: []string{"ns2"}, size: 100, active: 1},
+			},
+			quota:  DiskQuota{Namespace: 150},
+			reason: "the size 200.0B of namespace ns2 is over 150.0B",
+		},
+	}
+	for _, test := range tests {
+		m := newTestMirrors(os.TempDir(), test.mirrors)
+		victim, reason := m.nextEviction(&test.quota)
+		if len(test.victim) == 0 {
+			assert.Nil(t, victim, test.name)
+		} else if assert.NotNil(t, victim, test.name) {
+			assert.Equal(t, test.victim, victim.key, test.name)
+		}
+		assert.Equal(t, test.reason, reason, test.name)
+	}
+}
+
+// writeMirror creates the directory of the mirror with a file of the given size
+func writeMirror(t *testing.T, mr *mirror, size int) {
+	err := os.MkdirAll(mr.dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(mr.dir, "pack"), make([]byte, size), 0600)
+	}
+	if err != nil {
+		t.Fatalf("Failed to write the mirror %s due to %v", mr.dir, err)
+	}
+}
+
+func TestEnforceQuota(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	defer os.RemoveAll(workDir)
+	m := newTestMirrors(workDir, []testMirror{
+		{name: "a", namespaces: []string{"ns1"}, lastUsed: 3 * time.Hour},
+		{name: "b", namespaces: []string{"ns1"}, lastUsed: 2 * time.Hour},
+		{name: "c", namespaces: []string{"ns2"}, lastUsed: time.Hour},
+		{name: "d", namespaces: []string{"ns2"}},
+	})
+	for _, mr := range m.mirrors {
+		writeMirror(t, mr, 100)
+		m.measure(mr, false)
+		assert.Equal(t, int64(100), mr.size, mr.key)
+	}
+
+	// the size is only measured again when the mirror changed
+	d := m.mirrors["d"]
+	writeMirror(t, d, 200)
+	m.measure(d, false)
+	assert.Equal(t, int64(100), d.size)
+	m.measure(d, true)
+	assert.Equal(t, int64(200), d.size)
+
+	m.enforceQuota(&DiskQuota{Total: 400})
+	assert.Equal(t, []string{"b", "c", "d"}, existingMirrors(m))
+	m.enforceQuota(&DiskQuota{Namespace: 250})
+	assert.Equal(t, []string{"b", "d"}, existingMirrors(m))
+	assert.Equal(t, int64(0), m.mirrors["c"].size)
+	assert.True(t, m.mirrors["c"].lastFetch.IsZero(), "an evicted mirror should be cloned again")
+}
+
+// existingMirrors returns the sorted keys of the mirrors whose directories exist
+func existingMirrors(m *mirrors) []string {
+	answer := []string{}
+	for key, mr := range m.mirrors {
+		if dirExists(mr.dir) {
+			answer = append(answer, key)
+		}
+	}
+	sort.Strings(answer)
+	return answer
+}
+
+func TestSweepWorkDir(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	defer os.RemoveAll(workDir)
+	b, _ := newTestWatcher(&fakeClient{}, &WatchFlags{WorkDir: workDir})
+	bc := testBuildConfig("myproject", "a", "1")
+	b.addBuildConfig(bc)
+
+	used := filepath.Join(workDir, mirrorsDir, mirrorDirName(mirrorKey(bc, bc.Spec.Source.Git)))
+	orphan := filepath.Join(workDir, mirrorsDir, mirrorDirName("https://github.com/fabric8io/deleted.git"))
+	oldClone := filepath.Join(workDir, "myproject", "a")
+	otherDir := filepath.Join(workDir, "other", "notes")
+	stateDir := filepath.Join(workDir, ".state", "myproject")
+	for _, dir := range []string{used, orphan, filepath.Join(oldClone, ".git"), otherDir, stateDir} {
+		assert.NoError(t, os.MkdirAll(dir, 0700))
+	}
+
+	b.sweepWorkDir()
+	assert.True(t, dirExists(used), "the mirror of the BuildConfig should be kept")
+	assert.False(t, dirExists(orphan), "the mirror no BuildConfig uses should be removed")
+	assert.False(t, dirExists(oldClone), "the clone of an older version should be removed")
+	assert.False(t, dirExists(filepath.Join(workDir, "myproject")), "the empty namespace directory should be removed")
+	assert.True(t, dirExists(otherDir), "directories which are not clones should be kept")
+	assert.True(t, dirExists(stateDir), "hidden directories should be kept")
+}
@@ -0,0 +1,167 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"time"
+)
+
+const (
+	defaultPollInterval      = 30 * time.Second
+	defaultMaxPollInterval   = 10 * time.Minute
+	defaultFailureBackoff    = 1 * time.Minute
+	defaultMaxFailureBackoff = 30 * time.Minute
+)
+
+// Schedule configures how often the git repository of each BuildConfig is polled.
+//
+// Repositories with new commits or recent builds are polled every PollInterval,
+// idle repositories back off exponentially up to MaxPollInterval and repositories
+// which fail back off exponentially from FailureBackoff up to MaxFailureBackoff
+type Schedule struct {
+	PollInterval      time.Duration
+	MaxPollInterval   time.Duration
+	FailureBackoff    time.Duration
+	MaxFailureBackoff time.Duration
+	RecentBuildPeriod time.Duration
+}
+
+// withDefaults returns a copy of the schedule with any missing values defaulted
+func (s Schedule) withDefaults() Schedule {
+	if s.PollInterval <= 0 {
+		s.PollInterval = defaultPollInterval
+	}
+	if s.MaxPollInterval < s.PollInterval {
+		s.MaxPollInterval = s.PollInterval
+	}
+	if s.FailureBackoff <= 0 {
+		s.FailureBackoff = defaultFailureBackoff
+	}
+	if s.MaxFailureBackoff < s.FailureBackoff {
+		s.MaxFailureBackoff = s.FailureBackoff
+	}
+	return s
+}
+
+// backoff doubles the delay for each attempt after the first up to the maximum
+func backoff(delay time.Duration, max time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < max; i++ {
+		delay = delay * 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// reschedule works out when the collector is next due based on the result of processing it
+func (w *BuildConfigCollector) reschedule(s *Schedule, count int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	if err != nil {
+		w.failures++
+		w.nextDue = now.Add(backoff(s.FailureBackoff, s.MaxFailureBackoff, w.failures))
+		return
+	}
+	w.failures = 0
+	if count > 0 || w.hasRecentBuild(s, now) || w.pollInterval == 0 {
+		w.pollInterval = s.PollInterval
+	} else {
+		// no new commits so lets back off
+		w.pollInterval = w.pollInterval * 2
+		if w.pollInterval > s.MaxPollInterval {
+			w.pollInterval = s.MaxPollInterval
+		}
+	}
+	w.nextDue = now.Add(w.pollInterval)
+}
+
+// hasRecentBuild returns true if a build was triggered recently; the lock must be held
+func (w *BuildConfigCollector) hasRecentBuild(s *Schedule, now time.Time) bool {
+	return !w.lastBuild.IsZero() && now.Sub(w.lastBuild) < s.RecentBuildPeriod
+}
+
+// pollNow makes the collector due immediately and fetches its git repository
+// even if another BuildConfig using the same mirror fetched it recently
+func (w *BuildConfigCollector) pollNow() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.nextDue = time.Time{}
+	w.fetchRequested = true
+}
+
+// buildTriggered records that a new build was triggered and makes the collector due immediately
+// fetching its git repository as its likely that there are new commits
+func (w *BuildConfigCollector) buildTriggered() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastBuild = time.Now()
+	w.nextDue = time.Time{}
+	w.pollInterval = 0
+	w.fetchRequested = true
+}
+
+// takeFetchRequest returns true if the next poll must fetch the git repository, clearing the request
+func (w *BuildConfigCollector) takeFetchRequest() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	answer := w.fetchRequested
+	w.fetchRequested = false
+	return answer
+}
+
+// requestFetch makes the next poll fetch the git repository such as when the requested fetch failed
+func (w *BuildConfigCollector) requestFetch() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.fetchRequested = true
+}
+
+// due returns when the collector is next due and whether it has had a recent build.
+// The returned flag ok is false if the collector is currently being processed
+func (w *BuildConfigCollector) due(s *Schedule, now time.Time) (nextDue time.Time, recentBuild bool, ok bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.nextDue, w.hasRecentBuild(s, now), !w.busy
+}
+
+// nextCollector returns the collector which is most overdue and not being processed by
+// another worker, marking it as busy. Collectors with recent builds are picked first.
+// Returns nil if no collector is due
+func (b *Watcher) nextCollector() *BuildConfigCollector {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	var answer *BuildConfigCollector
+	var answerDue time.Time
+	answerRecent := false
+	for _, bw := range b.collectors {
+		nextDue, recent, ok := bw.due(&b.schedule, now)
+		if !ok || nextDue.After(now) {
+			continue
+		}
+		if answer == nil || (recent && !answerRecent) || (recent == answerRecent && nextDue.Before(answerDue)) {
+			answer = bw
+			answerDue = nextDue
+			answerRecent = recent
+		}
+	}
+	if answer != nil && answer.acquire() {
+		return answer
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		delay    time.Duration
+		max      time.Duration
+		attempts int
+		expected time.Duration
+	}{
+		{time.Minute, 30 * time.Minute, 0, time.Minute},
+		{time.Minute, 30 * time.Minute, 1, time.Minute},
+		{time.Minute, 30 * time.Minute, 2, 2 * time.Minute},
+		{time.Minute, 30 * time.Minute, 5, 16 * time.Minute},
+		{time.Minute, 30 * time.Minute, 6, 30 * time.Minute},
+		{time.Minute, 30 * time.Minute, 1000, 30 * time.Minute},
+		{time.Hour, 30 * time.Minute, 1, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		actual := backoff(test.delay, test.max, test.attempts)
+		assert.Equal(t, test.expected, actual, "backoff(%v, %v, %d)", test.delay, test.max, test.attempts)
+	}
+}
+
+func TestScheduleWithDefaults(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		expected Schedule
+	}{
+		{
+			schedule: Schedule{},
+			expected: Schedule{
+				PollInterval:      defaultPollInterval,
+				MaxPollInterval:   defaultPollInterval,
+				FailureBackoff:    defaultFailureBackoff,
+				MaxFailureBackoff: defaultFailureBackoff,
+			},
+		},
+		{
+			schedule: Schedule{PollInterval: time.Minute, MaxPollInterval: time.Second, FailureBackoff: time.Second, MaxFailureBackoff: time.Hour},
+			expected: Schedule{PollInterval: time.Minute, MaxPollInterval: time.Minute, FailureBackoff: time.Second, MaxFailureBackoff: time.Hour},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.schedule.withDefaults(), "%+v", test.schedule)
+	}
+}
+
+func TestReschedule(t *testing.T) {
+	s := &Schedule{
+		PollInterval:      time.Minute,
+		MaxPollInterval:   5 * time.Minute,
+		FailureBackoff:    10 * time.Second,
+		MaxFailureBackoff: 30 * time.Second,
+		RecentBuildPeriod: time.Hour,
+	}
+	failed := errors.New("failed")
+	tests := []struct {
+		name         string
+		pollInterval time.Duration
+		failures     int
+		lastBuild    time.Time
+		count        int
+		err          error
+		expectedWait time.Duration
+	}{
+		{name: "first poll", count: 0, expectedWait: time.Minute},
+		{name: "new commits", pollInterval: 4 * time.Minute, count: 3, expectedWait: time.Minute},
+		{name: "idle backs off", pollInterval: time.Minute, expectedWait: 2 * time.Minute},
+		{name: "idle up to the maximum", pollInterval: 4 * time.Minute, expectedWait: 5 * time.Minute},
+		{name: "recent build", pollInterval: 4 * time.Minute, lastBuild: time.Now().Add(-time.Minute), expectedWait: time.Minute},
+		{name: "old build", pollInterval: 4 * time.Minute, lastBuild: time.Now().Add(-2 * time.Hour), expectedWait: 5 * time.Minute},
+		{name: "first failure", pollInterval: time.Minute, err: failed, expectedWait: 10 * time.Second},
+		{name: "second failure", failures: 1, err: failed, expectedWait: 20 * time.Second},
+		{name: "many failures", failures: 10, err: failed, expectedWait: 30 * time.Second},
+	}
+	for _, test := range tests {
+		w := &BuildConfigCollector{
+			pollInterval: test.pollInterval,
+			failures:     test.failures,
+			lastBuild:    test.lastBuild,
+		}
+		before := time.Now()
+		w.reschedule(s, test.count, test.err)
+		wait := w.nextDue.Sub(before)
+		assert.True(t, wait >= test.expectedWait && wait < test.expectedWait+time.Second, "%s: expected a wait of %v but was %v", test.name, test.expectedWait, wait)
+		if test.err != nil {
+			assert.Equal(t, test.failures+1, w.failures, test.name)
+		} else {
+			assert.Equal(t, 0, w.failures, test.name)
+		}
+	}
+}
+
+func TestNextCollector(t *testing.T) {
+	now := time.Now()
+	overdue := &BuildConfigCollector{name: "overdue", nextDue: now.Add(-time.Hour)}
+	due := &BuildConfigCollector{name: "due", nextDue: now.Add(-time.Minute)}
+	recent := &BuildConfigCollector{name: "recent", nextDue: now.Add(-time.Second), lastBuild: now}
+	busy := &BuildConfigCollector{name: "busy", nextDue: now.Add(-2 * time.Hour), busy: true}
+	later := &BuildConfigCollector{name: "later", nextDue: now.Add(time.Hour)}
+	b := &Watcher{
+		schedule:   Schedule{RecentBuildPeriod: time.Hour},
+		collectors: []*BuildConfigCollector{later, busy, due, overdue, recent},
+	}
+
+	expected := []string{"recent", "overdue", "due"}
+	for _, name := range expected {
+		bw := b.nextCollector()
+		if assert.NotNil(t, bw, "expected %s", name) {
+			assert.Equal(t, name, bw.name)
+			assert.True(t, bw.busy, "%s should be busy", name)
+		}
+	}
+	assert.Nil(t, b.nextCollector(), "no more collectors should be due")
+}
+
+func TestFetchRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  func(w *BuildConfigCollector)
+		expected bool
+	}{
+		{"scheduled poll", func(w *BuildConfigCollector) {}, false},
+		{"poll now", (*BuildConfigCollector).pollNow, true},
+		{"build triggered", (*BuildConfigCollector).buildTriggered, true},
+		{"failed fetch", (*BuildConfigCollector).requestFetch, true},
+	}
+	for _, test := range tests {
+		w := &BuildConfigCollector{}
+		test.request(w)
+		assert.Equal(t, test.expected, w.takeFetchRequest(), test.name)
+		assert.False(t, w.takeFetchRequest(), "%s: the request should be cleared", test.name)
+	}
+}
@@ -1,136 +1,343 @@
 package watcher
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fabric8io/gitcollector/pkg/gitbackend"
 	"github.com/fabric8io/gitcollector/pkg/publisher"
+	"github.com/fabric8io/gitcollector/pkg/state"
 	"github.com/fabric8io/gitcollector/pkg/util"
 	buildapi "github.com/openshift/origin/pkg/build/api"
 	oclient "github.com/openshift/origin/pkg/client"
-	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
 	k8sclient "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/watch"
 )
 
 const (
-	noProjectSleepDelay  = 1 * time.Second
-	afterEventSleepDelay = 1 * time.Second
+	noProjectSleepDelay = 1 * time.Second
+
+	defaultWorkers = 4
+
+	defaultCloneTimeout = 10 * time.Minute
+	defaultFetchTimeout = 5 * time.Minute
+	defaultReadTimeout  = 1 * time.Minute
+
+	stateStoreFile      = "file"
+	stateStoreConfigMap = "configmap"
+	stateStoreNone      = "none"
+
+	// CommitRetentionDelete removes the commits of a BuildConfig from the sinks when it is
+	// deleted or its git source changes whereas CommitRetentionKeep keeps them
+	CommitRetentionDelete = "delete"
+	CommitRetentionKeep   = "keep"
+
+	// stateDir is the directory inside the work directory used by the file state store
+	stateDir = ".state"
+	// outboxDir is the directory inside the work directory of the queue of publishes
+	outboxDir = ".outbox"
 
 	externalGitUri = "fabric8.io/git-clone-url"
 
 	useGithub = false
-	useGoGit  = false
 )
 
 type WatchFlags struct {
-	WorkDir        string
-	Namespace      string
-	ExternalGitUrl bool
+	WorkDir             string
+	Namespace           string
+	Namespaces          []string
+	NamespaceSelector   string
+	AllNamespaces       bool
+	BuildConfigSelector string
+	FollowProjects      bool
+	ResyncPeriod        time.Duration
+	Workers             int
+	Schedule            Schedule
+	GitTimeouts         GitTimeouts
+	DiskQuota           DiskQuota
+	Backfill            Backfill
+	BatchSize           int
+	Clone               gitbackend.Options
+	StateStore          string
+	StateNamespace      string
+	StateConfigMap      string
+	GitBackend          string
+	IgnoreContextDir    bool
+	ExternalGitUrl      bool
+	// Sinks are where the BuildConfigs and commits are published which defaults
+	// to the WIT and Elasticsearch services found from the environment variables
+	Sinks []publisher.Sink
+	// SinkHTTP is how the sinks found from the environment variables authenticate and connect
+	SinkHTTP      publisher.HTTPOptions
+	WIT           publisher.WITOptions
+	Elasticsearch publisher.ElasticsearchOptions
+	PublishRetry  publisher.RetryOptions
+	// CommitRetention is whether the published commits of a BuildConfig are deleted or kept
+	// when it is deleted or its git source changes
+	CommitRetention string
+	MetricsAddress  string
+}
+
+// Validate returns an error if the flags, including any values from the configuration
+// file, contradict each other
+func (f *WatchFlags) Validate() error {
+	if f.AllNamespaces && (len(f.Namespace) > 0 || len(f.Namespaces) > 0 || len(f.NamespaceSelector) > 0) {
+		return fmt.Errorf("--allNamespaces can't be combined with --namespace, --namespaces or --namespaceSelector")
+	}
+	return nil
+}
+
+// GitTimeouts are the deadlines of the git operations for each BuildConfig
+type GitTimeouts struct {
+	Clone time.Duration
+	Fetch time.Duration
+	// Read is the deadline for reading the history of the clone
+	Read time.Duration
+}
+
+// withDefaults returns a copy of the timeouts with any missing values defaulted
+func (t GitTimeouts) withDefaults() GitTimeouts {
+	if t.Clone <= 0 {
+		t.Clone = defaultCloneTimeout
+	}
+	if t.Fetch <= 0 {
+		t.Fetch = defaultFetchTimeout
+	}
+	if t.Read <= 0 {
+		t.Read = defaultReadTimeout
+	}
+	return t
 }
 
 type Watcher struct {
-	kubeClient *k8sclient.Client
-	osClient   *oclient.Client
-	publisher  publisher.Publisher
-	watch      *watch.Interface
-	flags      *WatchFlags
+	kubeClient    *k8sclient.Client
+	osClient      openshiftClient
+	publisher     publisher.Sink
+	outboxes      []*publisher.Outbox
+	stateStore    state.StateStore
+	backend       gitbackend.Backend
+	mirrors       *mirrors
+	watches       map[string]*namespaceWatch
+	events        chan watch.Event
+	projectEvents chan watch.Event
+	resyncs       chan resyncEvent
+	flags         *WatchFlags
+
+	workDir  string
+	schedule Schedule
+	timeouts GitTimeouts
+	backfill Backfill
 
-	namespace       string
-	workDir         string
-	currentPosition int
-	collectors      []*BuildConfigCollector
+	// lock guards the collectors which are updated by the watch while being processed by the workers
+	lock       sync.Mutex
+	collectors []*BuildConfigCollector
 }
 
+// New creates a Watcher which publishes through the durable outbox in the work directory
 func New(c *k8sclient.Client, oc *oclient.Client, flags *WatchFlags) Watcher {
-	pub := publisher.New()
+	return newWatcher(c, oc, flags, true)
+}
+
+// newWatcher creates a Watcher which either queues publishes in the outbox or publishes
+// directly to the sinks, such as when backfilling, so that failures are returned straight away
+func newWatcher(c *k8sclient.Client, oc *oclient.Client, flags *WatchFlags, useOutbox bool) Watcher {
+	sinks := flags.Sinks
+	if len(sinks) == 0 {
+		envSinks, err := publisher.EnvSinks(flags.SinkHTTP, flags.WIT, flags.Elasticsearch)
+		if err != nil {
+			util.Fatalf("Unable to create the publisher sinks due to: %v\n", err)
+		}
+		sinks = envSinks
+	}
+	switch flags.CommitRetention {
+	case "", CommitRetentionDelete, CommitRetentionKeep:
+	default:
+		util.Fatalf("Unknown commit retention %s. Supported values are %s or %s\n", flags.CommitRetention, CommitRetentionDelete, CommitRetentionKeep)
+	}
 	workDir := flags.WorkDir
 	err := os.MkdirAll(workDir, 0700)
 	if err != nil {
 		util.Errorf("Unable to create work directory %s due to: %v\n", workDir, err)
 	}
+	stateStore, err := newStateStore(c, flags)
+	if err != nil {
+		util.Fatalf("Unable to create the state store due to: %v\n", err)
+	}
+	backend, err := gitbackend.New(flags.GitBackend, flags.Clone)
+	if err != nil {
+		util.Fatalf("Unable to create the git backend due to: %v\n", err)
+	}
+	util.Infof("Using the %s git backend\n", backend.Name())
+	outboxes := []*publisher.Outbox{}
+	if useOutbox {
+		outboxes, err = publisher.NewOutboxes(filepath.Join(workDir, outboxDir), sinks, flags.PublishRetry)
+		if err != nil {
+			util.Fatalf("Unable to create the publish outboxes due to: %v\n", err)
+		}
+		// lets publish to the outbox of each sink so that each sink is delivered to independently
+		sinks = []publisher.Sink{}
+		for _, outbox := range outboxes {
+			sinks = append(sinks, outbox)
+		}
+	}
+	pub := publisher.New(sinks...)
 	return Watcher{
-		kubeClient:      c,
-		osClient:        oc,
-		publisher:       pub,
-		flags:           flags,
-		namespace:       flags.Namespace,
-		workDir:         workDir,
-		collectors:      []*BuildConfigCollector{},
-		currentPosition: -1,
+		kubeClient:    c,
+		osClient:      &originClient{oc: oc},
+		publisher:     &pub,
+		outboxes:      outboxes,
+		stateStore:    stateStore,
+		backend:       backend,
+		mirrors:       newMirrors(workDir),
+		flags:         flags,
+		watches:       map[string]*namespaceWatch{},
+		events:        make(chan watch.Event),
+		projectEvents: make(chan watch.Event),
+		resyncs:       make(chan resyncEvent),
+		workDir:       workDir,
+		schedule:      flags.Schedule.withDefaults(),
+		timeouts:      flags.GitTimeouts.withDefaults(),
+		backfill:      flags.Backfill.withDefaults(),
+		collectors:    []*BuildConfigCollector{},
 	}
 }
 
-func (b *Watcher) Run(stopCh <-chan struct{}) error {
-	ns := b.namespace
-	opts := kapi.ListOptions{}
-	oc := b.osClient
+// newStateStore creates the StateStore used to persist the collector cursors
+func newStateStore(c *k8sclient.Client, flags *WatchFlags) (state.StateStore, error) {
+	switch flags.StateStore {
+	case "", stateStoreFile:
+		return state.NewFileStore(filepath.Join(flags.WorkDir, stateDir))
+	case stateStoreConfigMap:
+		if len(flags.StateNamespace) == 0 {
+			return nil, fmt.Errorf("No namespace specified for the state ConfigMap %s", flags.StateConfigMap)
+		}
+		return state.NewConfigMapStore(c, flags.StateNamespace, flags.StateConfigMap), nil
+	case stateStoreNone:
+		return state.NewNoopStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown state store %s. Supported values are %s, %s or %s", flags.StateStore, stateStoreFile, stateStoreConfigMap, stateStoreNone)
+	}
+}
 
-	bcl, err := oc.BuildConfigs(ns).List(opts)
+func (b *Watcher) Run(stopCh <-chan struct{}) error {
+	namespaces, projectsResourceVersion, err := b.resolveNamespaces()
 	if err != nil {
-		return fmt.Errorf("Failed to find BuildConfig resources in namespace %s due to %v", ns, err)
+		return err
 	}
-	util.Infof("Found %d BuildConfigs\n", len(bcl.Items))
-	for _, bc := range bcl.Items {
-		b.addBuildConfig(&bc)
+	for _, ns := range namespaces {
+		err = b.watchNamespace(ns, stopCh)
+		if err != nil {
+			return err
+		}
 	}
-
-	w, err := oc.BuildConfigs(ns).Watch(opts)
-	if err != nil {
-		return fmt.Errorf("Failed to watch BuildConfig resources in namespace %s due to %v", ns, err)
+	if b.followProjects() {
+		err = b.watchProjects(projectsResourceVersion, stopCh)
+		if err != nil {
+			return err
+		}
+	}
+	b.sweepWorkDir()
+	b.sweepCursors()
+	for _, outbox := range b.outboxes {
+		go outbox.Run(stopCh)
 	}
-	b.watch = &w
-	watchCh := w.ResultChan()
+	if len(b.flags.MetricsAddress) > 0 {
+		go b.serveMetrics(b.flags.MetricsAddress)
+	}
+
+	// the workers use a context so that any running git commands are killed when we stop
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := b.runWorkers(ctx)
+	defer workers.Wait()
+	defer cancel()
 	for {
 		select {
 		// check if we're shutdown
 		case <-stopCh:
 			return nil
 
-		case got, ok := <-watchCh:
-			if ok {
-				bc, isBC := got.Object.(*buildapi.BuildConfig)
-				if !isBC || bc == nil {
-					util.Warnf("received unknown object while watching for BuildConfig: %v\n", got.Object)
-				} else {
-					switch got.Type {
-					case watch.Added:
-						b.addBuildConfig(bc)
-					case watch.Modified:
-						b.modifyBuildConfig(bc)
-					case watch.Deleted:
-						b.deleteBuildConfig(bc)
-					}
-
+		case got := <-b.events:
+			bc, isBC := got.Object.(*buildapi.BuildConfig)
+			if !isBC || bc == nil {
+				util.Warnf("received unknown object while watching for BuildConfig: %v\n", got.Object)
+			} else if b.isWatchedNamespace(bc.Namespace) {
+				switch got.Type {
+				case watch.Added:
+					b.addBuildConfig(bc)
+				case watch.Modified:
+					b.modifyBuildConfig(bc)
+				case watch.Deleted:
+					b.deleteBuildConfig(bc)
 				}
 			}
 
+		case got := <-b.projectEvents:
+			b.onProjectEvent(got, stopCh)
+
+		case got := <-b.resyncs:
+			b.onResync(got, stopCh)
+		}
+	}
+}
+
+// runWorkers starts the pool of workers which process the collectors in parallel
+// returning a WaitGroup which completes when all the workers have stopped
+func (b *Watcher) runWorkers(ctx context.Context) *sync.WaitGroup {
+	workers := b.flags.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	util.Infof("Starting %d workers\n", workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.runWorker(ctx)
+		}()
+	}
+	return &wg
+}
+
+// batchSize returns the maximum number of commits published for a BuildConfig each time it is processed
+func (b *Watcher) batchSize() int {
+	if b.flags.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return b.flags.BatchSize
+}
+
+func (b *Watcher) runWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
 		default:
-			// TODO should we sleep so we don't DOS the back end? :)
-			b.processNextBuildConfig()
+			b.processNextBuildConfig(ctx)
 		}
 	}
-	<-stopCh
-	return nil
 }
 
-func (b *Watcher) processNextBuildConfig() {
-	size := len(b.collectors)
-	if size == 0 {
+func (b *Watcher) processNextBuildConfig(ctx context.Context) {
+	buildWatch := b.nextCollector()
+	if buildWatch == nil {
 		time.Sleep(noProjectSleepDelay)
 		return
 	}
-	pos := b.currentPosition + 1
-	if pos >= size {
-		pos = 0
-	}
-	b.currentPosition = pos
-	buildWatch := b.collectors[pos]
-	if buildWatch.Process() > 0 {
-		time.Sleep(afterEventSleepDelay)
+	count, err := buildWatch.Process(ctx)
+	if err != nil {
+		util.Warnf("%v\n", err)
 	}
+	buildWatch.reschedule(&b.schedule, count, err)
+	buildWatch.release()
+	b.mirrors.enforceQuota(&b.flags.DiskQuota)
 }
 
 func (b *Watcher) addBuildConfig(bc *buildapi.BuildConfig) {
@@ -152,56 +359,140 @@ func (b *Watcher) upsertBuildConfig(bc *buildapi.BuildConfig, add bool) {
 	if newGS == nil {
 		return
 	}
-	util.Infof("%s BuildConfig %s with source %v\n", message, name, newGS)
-	var buildWatch *BuildConfigCollector = nil
-	for _, bw := range b.collectors {
-		if name == bw.name {
-			buildWatch = bw
-			break
-		}
-	}
+	key := collectorKey(ns, name)
+	util.Infof("%s BuildConfig %s with source %v\n", message, key, newGS)
+	b.lock.Lock()
+	buildWatch := b.findCollector(key)
 	var oldBc *buildapi.BuildConfig = nil
 	if buildWatch == nil {
 		buildWatch = &BuildConfigCollector{
 			name:        name,
+			namespace:   ns,
 			watcher:     b,
 			buildConfig: *bc,
-			workDir:     filepath.Join(b.workDir, ns, name),
 		}
 		b.collectors = append(b.collectors, buildWatch)
 	} else {
-		oldBc = &buildWatch.buildConfig
-		buildWatch.buildConfig = *bc
+		old := buildWatch.update(bc)
+		oldBc = &old
 	}
+	b.lock.Unlock()
 
 	if oldBc != nil {
 		oldGS := b.GitSource(oldBc)
 		if removeOldGitSource(oldGS, newGS) {
 			// the git branch/repo has changed so lets remove the data
-			util.Infof("Git source changed for %s so lets remove old files as its %v and was %v\n", name, newGS, oldGS)
-			buildWatch.Delete()
+			util.Infof("Git source changed for %s so lets remove old files as its %v and was %v\n", key, newGS, oldGS)
+			buildWatch.Delete(unpublishCommits)
+			buildWatch.pollNow()
+		}
+		if bc.Status.LastVersion > oldBc.Status.LastVersion {
+			buildWatch.buildTriggered()
 		}
+	}
+	err := b.publisher.UpsertBuildConfig(bc)
+	if err != nil {
+		util.Warnf("Failed to publish BuildConfig %s due to %v\n", key, err)
+	}
+}
 
+// collector returns the BuildConfigCollector for the given key or nil if there is none
+func (b *Watcher) collector(key string) *BuildConfigCollector {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.findCollector(key)
+}
+
+// snapshotCollectors returns a copy of the current collectors
+func (b *Watcher) snapshotCollectors() []*BuildConfigCollector {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]*BuildConfigCollector{}, b.collectors...)
+}
+
+// findCollector returns the BuildConfigCollector for the given key; the lock must be held
+func (b *Watcher) findCollector(key string) *BuildConfigCollector {
+	for _, bw := range b.collectors {
+		if key == bw.key() {
+			return bw
+		}
 	}
-	b.publisher.UpsertBuildConfig(bc)
+	return nil
 }
 
 func (b *Watcher) deleteBuildConfig(bc *buildapi.BuildConfig) {
-	name := bc.Name
-	util.Infof("removing BuildConfig %s\n", name)
+	key := collectorKey(bc.Namespace, bc.Name)
+	util.Infof("removing BuildConfig %s\n", key)
+	b.lock.Lock()
+	var removed *BuildConfigCollector
 	for i, bw := range b.collectors {
-		if name == bw.name {
-			bw.Delete()
+		if key == bw.key() {
+			removed = bw
 			s := b.collectors
 			b.collectors = append(s[:i], s[i+1:]...)
-
-			// lets avoid missing the next item when we process things
-			if b.currentPosition >= i {
-				b.currentPosition -= 1
-			}
 			break
 		}
 	}
+	b.lock.Unlock()
+
+	// deleting calls the state store and the sinks so lets not block the workers meanwhile
+	if removed != nil {
+		removed.Delete(unpublishBuildConfig)
+	}
+}
+
+// unpublish removes the BuildConfig and its commits from the sinks; the commits are
+// kept if the commit retention is keep
+func (b *Watcher) unpublish(namespace string, name string, mode unpublishMode) {
+	key := collectorKey(namespace, name)
+	if mode == unpublishBuildConfig {
+		util.Infof("Removing BuildConfig %s from the sinks\n", key)
+		err := b.publisher.DeleteBuildConfig(namespace, name)
+		if err != nil {
+			util.Warnf("Failed to remove BuildConfig %s from the sinks due to %v\n", key, err)
+		}
+	}
+	if mode == unpublishNone || b.flags.CommitRetention == CommitRetentionKeep {
+		return
+	}
+	util.Infof("Removing the commits of BuildConfig %s from the sinks\n", key)
+	err := b.publisher.DeleteGitCommits(namespace, name)
+	if err != nil {
+		util.Warnf("Failed to remove the commits of BuildConfig %s from the sinks due to %v\n", key, err)
+	}
+}
+
+// sweepCursors removes the cursors of the BuildConfigs which are not being collected. Those
+// deleted while the operator was down are also removed from the sinks, like any other deleted
+// BuildConfig, whereas those which still exist, such as in a namespace no longer watched, are kept
+func (b *Watcher) sweepCursors() {
+	cursors, err := b.stateStore.List()
+	if err != nil {
+		util.Warnf("Failed to list the cursors due to %v\n", err)
+		return
+	}
+	for _, cursor := range cursors {
+		ns := cursor.Namespace
+		name := cursor.BuildConfigName
+		key := collectorKey(ns, name)
+		if b.collector(key) != nil {
+			continue
+		}
+		_, err := b.osClient.GetBuildConfig(ns, name)
+		if err == nil {
+			util.Infof("Removing the cursor of BuildConfig %s as it is no longer collected\n", key)
+		} else if kerrors.IsNotFound(err) {
+			util.Infof("Removing BuildConfig %s as it was deleted while the operator was down\n", key)
+			b.unpublish(ns, name, unpublishBuildConfig)
+		} else {
+			util.Warnf("Failed to find BuildConfig %s so keeping its cursor due to %v\n", key, err)
+			continue
+		}
+		err = b.stateStore.Delete(ns, name)
+		if err != nil {
+			util.Warnf("Failed to remove the cursor for %s due to %v\n", key, err)
+		}
+	}
 }
 
 func (b *Watcher) GitSource(bc *buildapi.BuildConfig) *buildapi.GitBuildSource {
@@ -228,6 +519,16 @@ func (b *Watcher) GitSource(bc *buildapi.BuildConfig) *buildapi.GitBuildSource {
 	return nil
 }
 
+// contextDir returns the directory in the git repository the BuildConfig is built from
+// or an empty string if the whole repository is used or context directories are ignored
+func (b *Watcher) contextDir(bc *buildapi.BuildConfig) string {
+	if b.flags.IgnoreContextDir {
+		return ""
+	}
+	dir := path.Clean("/" + bc.Spec.Source.ContextDir)
+	return strings.TrimPrefix(dir, "/")
+}
+
 func removeOldGitSource(old *buildapi.GitBuildSource, new *buildapi.GitBuildSource) bool {
 	if old == new || old == nil || len(old.URI) == 0 {
 		return false
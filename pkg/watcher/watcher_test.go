@@ -0,0 +1,94 @@
+/**
+ * Copyright (C) 2015 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabric8io/gitcollector/pkg/state"
+)
+
+// blockingStore is a state store whose Delete blocks until it is released
+type blockingStore struct {
+	state.StateStore
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingStore) Delete(namespace string, name string) error {
+	s.deleting <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestDeleteDoesNotBlockWorkers(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(b *Watcher)
+	}{
+		{
+			name: "deleted BuildConfig",
+			delete: func(b *Watcher) {
+				b.deleteBuildConfig(testBuildConfig("one", "a", "1"))
+			},
+		},
+		{
+			name: "unwatched namespace",
+			delete: func(b *Watcher) {
+				b.unwatchNamespace("one", unpublishBuildConfig)
+			},
+		},
+	}
+	for _, test := range tests {
+		b, _ := newTestWatcher(&fakeClient{}, &WatchFlags{})
+		store := &blockingStore{
+			StateStore: state.NewNoopStore(),
+			deleting:   make(chan struct{}),
+			release:    make(chan struct{}),
+		}
+		b.stateStore = store
+		b.watches["one"] = &namespaceWatch{namespace: "one", stopc: make(chan struct{})}
+		b.addBuildConfig(testBuildConfig("one", "a", "1"))
+		b.addBuildConfig(testBuildConfig("two", "b", "1"))
+
+		done := make(chan struct{})
+		go func() {
+			test.delete(b)
+			close(done)
+		}()
+		select {
+		case <-store.deleting:
+		case <-time.After(testTimeout):
+			t.Fatalf("%s: timed out waiting for the cursor to be deleted", test.name)
+		}
+		// the workers can pick the other collectors while the cursor is being deleted
+		picked := make(chan *BuildConfigCollector)
+		go func() {
+			picked <- b.nextCollector()
+		}()
+		select {
+		case bw := <-picked:
+			if bw == nil || bw.key() != "two/b" {
+				t.Errorf("%s: expected the collector two/b to be picked but was %v", test.name, bw)
+			}
+		case <-time.After(testTimeout):
+			t.Errorf("%s: the workers were blocked while the collector was deleted", test.name)
+		}
+		close(store.release)
+		<-done
+	}
+}